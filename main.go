@@ -1,38 +1,119 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/text/unicode/norm"
 )
 
-func jsonResponse(w http.ResponseWriter, body map[string]any, err error) {
+// An error with the HTTP status to respond with and a stable code
+// clients can branch on. Errors that aren't apiErrors are reported as
+// 400 bad_request.
+type apiError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e apiError) Unwrap() error {
+	return e.err
+}
+
+func errInvalidQuery(err error) error {
+	return apiError{http.StatusBadRequest, "invalid_query", err}
+}
+
+func errNotFound(id string) error {
+	return apiError{http.StatusNotFound, "not_found", fmt.Errorf("Document not found: %s", id)}
+}
+
+func isNotFound(err error) bool {
+	var ae apiError
+	return errors.As(err, &ae) && ae.code == "not_found"
+}
+
+// Responses are compact unless the request asks for pretty=true
+func jsonResponse(w http.ResponseWriter, r *http.Request, body map[string]any, err error) {
 	data := map[string]any{
 		"body":   body,
 		"status": "ok",
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 	} else {
 		data["status"] = "error"
 		data["error"] = err.Error()
-		w.WriteHeader(http.StatusBadRequest)
+
+		status := http.StatusBadRequest
+		data["code"] = "bad_request"
+		var ae apiError
+		if errors.As(err, &ae) {
+			status = ae.status
+			data["code"] = ae.code
+		}
+		w.WriteHeader(status)
 	}
-	w.Header().Set("Content-Type", "application/json")
 
+	// Without the envelope the HTTP status says whether it succeeded
+	var response any = data
+	if r.URL.Query().Get("raw") == "true" {
+		response = body
+		if err != nil {
+			response = map[string]any{"error": data["error"], "code": data["code"]}
+		}
+	}
+
+	// Map keys are encoded sorted, recursively, so the same document
+	// always serializes the same way
 	enc := json.NewEncoder(w)
-	err = enc.Encode(data)
+	if r.URL.Query().Get("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	err = enc.Encode(response)
 	if err != nil {
-		// TODO: set up panic handler?
+		// Handled by the router's PanicHandler
 		panic(err)
 	}
 }
@@ -41,455 +122,6189 @@ type server struct {
 	db      *pebble.DB // Primary data
 	indexDb *pebble.DB // Index data
 	port    string
+
+	metrics *metrics
+
+	// Decode numbers as json.Number rather than float64 so large
+	// integers and precise decimals aren't rounded
+	useNumber bool
+	// Searches matching more documents than this fail, 0 means no limit
+	maxResults int
+	// Fail queries the index can't answer rather than reading every
+	// document
+	noScan bool
+	// Queries with more comparisons than this are rejected, 0 means no
+	// limit
+	maxQueryTerms int
+	// Friendly query keys mapped to the dotted path they stand for
+	aliases map[string]string
+	// Dotted paths mapped to the type their values are indexed and
+	// compared as: number, string, bool or date
+	schema map[string]string
+	// Dotted paths removed from documents before they're returned, or
+	// replaced with redactMask when it is set
+	redactions map[string]bool
+	redactMask string
+	// Numeric fields also indexed into buckets of this width so range
+	// queries only read the buckets they overlap
+	buckets map[string]float64
+	// Store arrays and scalars under valueKey instead of rejecting them
+	wrapNonObjects bool
+	// Reject documents nested deeper than this, 0 means no limit
+	maxDepth int
+	// Reject documents larger than this many bytes once encoded for
+	// storage, 0 means no limit
+	maxDocumentSize int
+	// Log searches taking longer than this, 0 disables the log
+	slowQuery time.Duration
+	// The default missingPolicies entry for range comparisons
+	missingRange string
+	// Dotted path that values without a key are compared against, e.g.
+	// foo means name:foo
+	defaultField string
+	// Caches search responses until the next write when set
+	cache *resultCache
+	// Reject documents with duplicate keys or data after them
+	strictJSON bool
+	// Dotted paths of string fields indexed by token, "*" for all
+	tokenizedFields map[string]bool
+	// Index and query strings in Unicode normal form C so composed and
+	// decomposed characters match
+	normalize bool
+	// Dotted paths, and everything under them, to index exclusively or
+	// to leave out of the index. At most one is set.
+	indexInclude map[string]bool
+	indexExclude map[string]bool
+
+	// Serializes reading and writing postings
+	indexLock *sync.Mutex
+	// Index keys known to have postings, so ids can be merged onto
+	// them without reading them
+	postingsKeys *postingsKeyCache
+	// Serializes conditional inserts
+	insertLock *sync.Mutex
+	// Applies index updates in the background when set
+	indexWriter *indexWriter
+	// Skip indexing inserts, relying on POST /reindex instead
+	lazyIndex bool
+	// Count of documents inserted without being indexed since the last
+	// reindex
+	unindexed *int64
+	// Serve the /admin endpoints
+	admin bool
+	// DELETE marks documents deleted instead of removing them
+	softDelete bool
+	// Fsync index updates, documents are always synced
+	indexSync bool
+	// Store postings as 16 byte uuids rather than comma separated text
+	binaryPostings bool
+	// Fields with more distinct values than this stop being indexed, 0
+	// means no limit
+	maxCardinality int64
+	cardinality    *fieldCardinality
+	// Strings longer than this many bytes are stored but not indexed
+	// for exact matches, 0 means no limit
+	maxIndexedLength int
+	// Logs document writes before applying them when set
+	wal *writeAheadLog
+	// Generates time ordered ids when set, otherwise ids are random
+	// UUIDv4s
+	uuidV7 *uuidV7Generator
+	// The last sequence number in the insertion log
+	insertions *uint64
+	// Serves /collections/:name/ when set
+	collections *collections
 }
 
 func newServer(database string, port string) (*server, error) {
-	s := server{db: nil, port: port}
+	s := server{db: nil, port: port, metrics: newMetrics(), indexLock: &sync.Mutex{}, insertLock: &sync.Mutex{}, unindexed: new(int64), indexSync: true, cardinality: newFieldCardinality(), postingsKeys: newPostingsKeyCache(), insertions: new(uint64)}
 	var err error
 	s.db, err = pebble.Open(database, &pebble.Options{})
 	if err != nil {
 		return nil, err
 	}
 
-	s.indexDb, err = pebble.Open(database+".index", &pebble.Options{})
-	return &s, err
+	s.metrics.documents = int64(s.countDocuments())
+
+	s.indexDb, err = pebble.Open(database+".index", &pebble.Options{Merger: postingsMerger})
+	if err != nil {
+		return nil, err
+	}
+
+	*s.insertions, err = s.lastInsertion()
+	if err == nil && *s.insertions == 0 {
+		err = s.backfillInsertions()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, s.cardinality.load(s.indexDb)
 }
 
-// Ignores arrays
-func getPathValues(obj map[string]any, prefix string) []string {
-	var pvs []string
-	for key, val := range obj {
-		switch t := val.(type) {
-		case map[string]any:
-			pvs = append(pvs, getPathValues(t, key)...)
-			continue
-		case []interface{}:
-			// Can't handle arrays
-			continue
-		}
+func (s server) close() {
+	if s.indexWriter != nil {
+		s.indexWriter.close()
+	}
 
-		if prefix != "" {
-			key = prefix + "." + key
+	// Everything has been written to the index so it doesn't need to
+	// be rebuilt on the next startup. Unless documents inserted
+	// without indexing haven't been reindexed yet, then leaving the
+	// marker missing rebuilds the index with them.
+	err := s.indexDb.Flush()
+	if unindexed := atomic.LoadInt64(s.unindexed); err == nil && unindexed > 0 {
+		log.Printf("%d documents aren't indexed, the index will be rebuilt on startup", unindexed)
+	} else {
+		if err == nil {
+			err = s.indexDb.Set([]byte(documentCountKey), []byte(strconv.Itoa(s.countDocuments())), pebble.Sync)
 		}
+		if err == nil {
+			err = s.indexDb.Set([]byte(cleanShutdownKey), []byte(s.indexConfig()), pebble.Sync)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not mark clean shutdown: %s", err)
+	}
 
-		pvs = append(pvs, fmt.Sprintf("%s=%v", key, val))
+	if s.wal != nil {
+		s.wal.close()
 	}
 
-	return pvs
+	if s.collections != nil {
+		s.collections.close()
+	}
+
+	s.db.Close()
+	s.indexDb.Close()
 }
 
-func (s server) index(id string, document map[string]any) {
-	pv := getPathValues(document, "")
+// Stored in the index database while docdb isn't running, if it is
+// missing on startup docdb didn't shut down cleanly
+const cleanShutdownKey = "\x00meta\x00clean"
 
-	for _, pathValue := range pv {
-		idsString, closer, err := s.indexDb.Get([]byte(pathValue))
-		if err != nil && err != pebble.ErrNotFound {
-			log.Printf("Could not look up pathvalue [%#v]: %s", document, err)
-		}
+// How many documents there were at the last clean shutdown. A
+// different count on startup means the documents were changed without
+// the index, e.g. copied in from elsewhere.
+const documentCountKey = "\x00meta\x00documents"
 
-		if len(idsString) == 0 {
-			idsString = []byte(id)
-		} else {
-			ids := strings.Split(string(idsString), ",")
+const (
+	walSet    = "set"
+	walDelete = "delete"
+)
 
-			found := false
-			for _, existingId := range ids {
-				if id == existingId {
-					found = true
-				}
-			}
+type walEntry struct {
+	Op       string          `json:"op"`
+	Id       string          `json:"id"`
+	Document json.RawMessage `json:"document,omitempty"`
+}
 
-			if !found {
-				idsString = append(idsString, []byte(","+id)...)
-			}
-		}
+// Append-only log of document writes. Entries are fsynced before
+// they're applied so writes interrupted by a crash can be replayed on
+// startup. Writes are serialized so once the log is checkpointed every
+// entry in it has been applied.
+type writeAheadLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// Entries since the last checkpoint
+	entries int
+	// Truncate the log after this many entries
+	checkpointEvery int
+}
 
-		if closer != nil {
-			err = closer.Close()
-			if err != nil {
-				log.Printf("Could not close: %s", err)
-			}
-		}
-		err = s.indexDb.Set([]byte(pathValue), idsString, pebble.Sync)
+func openWriteAheadLog(path string, checkpointEvery int) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeAheadLog{file: file, checkpointEvery: checkpointEvery}, nil
+}
+
+func (l *writeAheadLog) write(entries []walEntry, apply func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		err := enc.Encode(entry)
 		if err != nil {
-			log.Printf("Could not update index: %s", err)
+			return err
 		}
 	}
-}
 
-func (s server) addDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	dec := json.NewDecoder(r.Body)
-	var document map[string]any
-	err := dec.Decode(&document)
+	info, err := l.file.Stat()
 	if err != nil {
-		jsonResponse(w, nil, err)
-		return
+		return fmt.Errorf("Could not write to write-ahead log: %s", err)
 	}
 
-	// New unique id for the document
-	id := uuid.New().String()
-
-	s.index(id, document)
-
-	bs, err := json.Marshal(document)
+	_, err = l.file.Write(buf.Bytes())
+	if err == nil {
+		err = l.file.Sync()
+	}
 	if err != nil {
-		jsonResponse(w, nil, err)
-		return
+		return fmt.Errorf("Could not write to write-ahead log: %s", err)
 	}
-	err = s.db.Set([]byte(id), bs, pebble.Sync)
+
+	err = apply()
 	if err != nil {
-		jsonResponse(w, nil, err)
-		return
+		// The write failed so it mustn't be replayed on startup
+		truncateErr := l.file.Truncate(info.Size())
+		if truncateErr == nil {
+			truncateErr = l.file.Sync()
+		}
+		if truncateErr != nil {
+			log.Printf("Could not drop failed write from write-ahead log: %s", truncateErr)
+		}
+		return err
 	}
 
-	jsonResponse(w, map[string]any{
-		"id": id,
-	}, nil)
-}
+	l.entries += len(entries)
+	if l.checkpointEvery > 0 && l.entries >= l.checkpointEvery {
+		return l.checkpointLocked()
+	}
 
-type queryComparison struct {
-	key   []string
-	value string
-	op    string
+	return nil
 }
 
-type query struct {
-	ands []queryComparison
+// Empties the log, everything in it must have been applied
+func (l *writeAheadLog) checkpointLocked() error {
+	err := l.file.Truncate(0)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not checkpoint write-ahead log: %s", err)
+	}
+
+	l.entries = 0
+	return nil
 }
 
-func getPath(doc map[string]any, parts []string) (any, bool) {
-	var docSegment any = doc
-	for _, part := range parts {
-		m, ok := docSegment.(map[string]any)
-		if !ok {
-			return nil, false
-		}
+// Reads every complete entry, a final entry cut short by a crash was
+// never applied and is ignored
+func (l *writeAheadLog) read() ([]walEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-		if docSegment, ok = m[part]; !ok {
-			return nil, false
+	_, err := l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []walEntry
+	dec := json.NewDecoder(l.file)
+	for {
+		var entry walEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
 		}
+
+		entries = append(entries, entry)
 	}
+}
 
-	return docSegment, true
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
 }
 
-func (q query) match(doc map[string]any) bool {
-	for _, argument := range q.ands {
-		value, ok := getPath(doc, argument.key)
-		if !ok {
-			return false
-		}
+// Applies any entries left in the write-ahead log, returning how many
+// were replayed. Entries may already have been applied, replaying them
+// again is harmless.
+func (s server) replayWriteAheadLog() (int, error) {
+	entries, err := s.wal.read()
+	if err != nil {
+		return 0, err
+	}
 
-		// Handle equality
-		if argument.op == "=" {
-			match := fmt.Sprintf("%v", value) == argument.value
-			if !match {
-				return false
-			}
+	if len(entries) == 0 {
+		return 0, nil
+	}
 
-			continue
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	replayed := 0
+	for _, entry := range entries {
+		switch entry.Op {
+		case walSet:
+			err = batch.Set([]byte(entry.Id), entry.Document, nil)
+		case walDelete:
+			err = batch.Delete([]byte(entry.Id), nil)
+		default:
+			err = fmt.Errorf("Unknown write-ahead log operation: %s", entry.Op)
 		}
 
-		// Handle <, >
-		right, err := strconv.ParseFloat(argument.value, 64)
+		// Entries that can't be applied are dropped with the rest of
+		// the log rather than failing every startup
 		if err != nil {
-			return false
+			log.Printf("Skipping write-ahead log entry [%#v]: %s", entry.Id, err)
+			continue
 		}
+		replayed++
+	}
 
-		var left float64
-		switch t := value.(type) {
-		case float64:
-			left = t
-		case float32:
-			left = float64(t)
-		case uint:
-			left = float64(t)
-		case uint8:
-			left = float64(t)
-		case uint16:
-			left = float64(t)
-		case uint32:
-			left = float64(t)
-		case uint64:
-			left = float64(t)
-		case int:
-			left = float64(t)
-		case int8:
-			left = float64(t)
-		case int16:
-			left = float64(t)
-		case int32:
-			left = float64(t)
-		case int64:
-			left = float64(t)
-		case string:
-			left, err = strconv.ParseFloat(t, 64)
-			if err != nil {
-				return false
-			}
-		default:
-			return false
-		}
+	err = batch.Commit(pebble.Sync)
+	if err != nil {
+		return 0, err
+	}
+	s.metrics.documents = int64(s.countDocuments())
 
-		if argument.op == ">" {
-			if left <= right {
-				return false
-			}
+	// The index may not reflect the replayed writes so make the next
+	// checkIndex rebuild it
+	err = s.indexDb.Delete([]byte(cleanShutdownKey), pebble.Sync)
+	if err != nil {
+		return 0, err
+	}
 
-			continue
-		}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	return replayed, s.wal.checkpointLocked()
+}
 
-		if left >= right {
-			return false
-		}
-	}
+// Bump when what gets indexed for a document or how it is stored
+// changes
+const indexVersion = 2
 
-	return true
+// Describes the flags that change what is indexed, so the index is
+// rebuilt when they change between runs
+func (s server) indexConfig() string {
+	bs, _ := json.Marshal(map[string]any{
+		"version":          indexVersion,
+		"tokenize":         sortedFields(s.tokenizedFields),
+		"include":          sortedFields(s.indexInclude),
+		"exclude":          sortedFields(s.indexExclude),
+		"normalize":        s.normalize,
+		"maxCardinality":   s.maxCardinality,
+		"schema":           s.schema,
+		"buckets":          s.buckets,
+		"maxIndexedLength": s.maxIndexedLength,
+	})
+	return string(bs)
 }
 
-// Handles either quoted strings or unquoted strings of only contiguous digits and letters
-func lexString(input []rune, index int) (string, int, error) {
-	if index >= len(input) {
-		return "", index, nil
+func sortedFields(fields map[string]bool) []string {
+	sorted := []string{}
+	for field := range fields {
+		sorted = append(sorted, field)
 	}
-	if input[index] == '"' {
-		index++
-		foundEnd := false
+	sort.Strings(sorted)
+	return sorted
+}
 
-		var s []rune
-		// TODO: handle nested quotes
-		for index < len(input) {
-			if input[index] == '"' {
-				foundEnd = true
-				break
-			}
+// Removes every key from the index
+func (s server) clearIndex() error {
+	s.postingsKeys.reset()
 
-			s = append(s, input[index])
-			index++
-		}
+	iter := s.indexDb.NewIter(nil)
+	defer iter.Close()
 
-		if !foundEnd {
-			return "", index, fmt.Errorf("Expected end of quoted string")
+	batch := s.indexDb.NewBatch()
+	defer batch.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		// The insertion log can't be rebuilt from the documents
+		if bytes.HasPrefix(iter.Key(), []byte(insertionKeyPrefix)) {
+			continue
 		}
 
-		return string(s), index + 1, nil
-	}
-
-	// If unquoted, read as much contiguous digits/letters as there are
-	var s []rune
-	var c rune
-	// TODO: someone needs to validate there's not ...
-	for index < len(input) {
-		c = input[index]
-		if !(unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.') {
-			break
+		err := batch.Delete(iter.Key(), nil)
+		if err != nil {
+			return err
 		}
-		s = append(s, c)
-		index++
 	}
-
-	if len(s) == 0 {
-		return "", index, fmt.Errorf("No string found")
+	if err := iter.Error(); err != nil {
+		return err
 	}
 
-	return string(s), index, nil
+	return batch.Commit(pebble.Sync)
 }
 
-// E.g. q=a.b:12
-func parseQuery(q string) (*query, error) {
-	if q == "" {
-		return &query{}, nil
+// Rebuilds the index if forced to or unless the last shutdown was
+// clean and indexed the same way, returning whether it did
+func (s server) checkIndex(force bool) (bool, error) {
+	config, closer, err := s.indexDb.Get([]byte(cleanShutdownKey))
+	if err != nil && err != pebble.ErrNotFound {
+		return false, err
 	}
 
-	i := 0
-	var parsed query
-	var qRune = []rune(q)
-	for i < len(qRune) {
-		// Eat whitespace
-		for unicode.IsSpace(qRune[i]) {
-			i++
-		}
-
-		key, nextIndex, err := lexString(qRune, i)
-		if err != nil {
-			return nil, fmt.Errorf("Expected valid key, got [%s]: `%s`", err, q[nextIndex:])
-		}
+	rebuild := force || err == pebble.ErrNotFound || string(config) != s.indexConfig()
+	if closer != nil {
+		closer.Close()
+	}
 
-		if q[nextIndex] != ':' {
-			return nil, fmt.Errorf("Expected colon at %d, got: `%s`", nextIndex, q[nextIndex:])
+	if !rebuild {
+		count, closer, err := s.indexDb.Get([]byte(documentCountKey))
+		if err != nil && err != pebble.ErrNotFound {
+			return false, err
 		}
-		i = nextIndex + 1
 
-		op := "="
-		if q[i] == '>' || q[i] == '<' {
-			op = string(q[i])
-			i++
+		// Indexes from before the count was stored don't have it
+		if err == nil {
+			documents := atomic.LoadInt64(&s.metrics.documents)
+			if string(count) != strconv.FormatInt(documents, 10) {
+				log.Printf("Index was written for %s documents but there are %d, rebuilding it", count, documents)
+				rebuild = true
+			}
+			closer.Close()
 		}
+	}
 
-		value, nextIndex, err := lexString(qRune, i)
+	if rebuild {
+		// Start over so nothing indexed under an old config or lost
+		// update lingers
+		err = s.clearIndex()
 		if err != nil {
-			return nil, fmt.Errorf("Expected valid value, got [%s]: `%s`", err, q[nextIndex:])
+			return false, err
 		}
-		i = nextIndex
-
-		argument := queryComparison{key: strings.Split(key, "."), value: value, op: op}
-		parsed.ands = append(parsed.ands, argument)
+		s.cardinality.reset()
+		s.reindex()
 	}
 
-	return &parsed, nil
+	// Until the next clean shutdown a crash leaves the marker missing
+	return rebuild, s.indexDb.Delete([]byte(cleanShutdownKey), pebble.Sync)
 }
 
-func (s server) getDocumentById(id []byte) (map[string]any, error) {
-	valBytes, closer, err := s.db.Get(id)
-	if err != nil {
-		return nil, err
+// Upper bounds of the search latency histogram buckets in seconds
+var searchDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Counters are updated atomically since handlers run concurrently
+type metrics struct {
+	documents    int64
+	inserts      int64
+	searches     int64
+	indexLookups int64
+	cacheHits    int64
+	// Bytes of the largest document written since startup
+	largestDocument int64
+
+	searchDurationBuckets []int64 // Not cumulative
+	searchDurationSum     int64   // Nanoseconds
+}
+
+func newMetrics() *metrics {
+	return &metrics{searchDurationBuckets: make([]int64, len(searchDurationBuckets)+1)}
+}
+
+func (m *metrics) observeDocumentSize(size int) {
+	for {
+		largest := atomic.LoadInt64(&m.largestDocument)
+		if int64(size) <= largest || atomic.CompareAndSwapInt64(&m.largestDocument, largest, int64(size)) {
+			return
+		}
 	}
-	defer closer.Close()
+}
 
-	var document map[string]any
-	err = json.Unmarshal(valBytes, &document)
-	return document, err
+func (m *metrics) observeSearch(d time.Duration) {
+	atomic.AddInt64(&m.searches, 1)
+	atomic.AddInt64(&m.searchDurationSum, int64(d))
+
+	bucket := sort.SearchFloat64s(searchDurationBuckets, d.Seconds())
+	atomic.AddInt64(&m.searchDurationBuckets[bucket], 1)
 }
 
-func (s server) lookup(pathValue string) ([]string, error) {
-	idsString, closer, err := s.indexDb.Get([]byte(pathValue))
-	if err != nil && err != pebble.ErrNotFound {
-		return nil, fmt.Errorf("Could not look up pathvalue [%#v]: %s", pathValue, err)
+// Writes the metrics in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer) {
+	counters := []struct {
+		name  string
+		typ   string
+		help  string
+		value *int64
+	}{
+		{"docdb_documents_total", "gauge", "Number of stored documents.", &m.documents},
+		{"docdb_inserts_total", "counter", "Number of documents inserted.", &m.inserts},
+		{"docdb_searches_total", "counter", "Number of searches run.", &m.searches},
+		{"docdb_index_lookups_total", "counter", "Number of index lookups made by searches.", &m.indexLookups},
+		{"docdb_search_cache_hits_total", "counter", "Number of searches answered from the result cache.", &m.cacheHits},
+		{"docdb_largest_document_bytes", "gauge", "Size of the largest document written since startup.", &m.largestDocument},
 	}
-	if closer != nil {
-		defer closer.Close()
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", c.name, c.help, c.name, c.typ, c.name, atomic.LoadInt64(c.value))
 	}
 
-	if len(idsString) == 0 {
-		return nil, nil
+	fmt.Fprintf(w, "# HELP docdb_search_duration_seconds Search latency.\n# TYPE docdb_search_duration_seconds histogram\n")
+	var count int64
+	for i, le := range searchDurationBuckets {
+		count += atomic.LoadInt64(&m.searchDurationBuckets[i])
+		fmt.Fprintf(w, "docdb_search_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), count)
 	}
+	count += atomic.LoadInt64(&m.searchDurationBuckets[len(searchDurationBuckets)])
+	fmt.Fprintf(w, "docdb_search_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "docdb_search_duration_seconds_sum %s\n", strconv.FormatFloat(time.Duration(atomic.LoadInt64(&m.searchDurationSum)).Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "docdb_search_duration_seconds_count %d\n", count)
+}
 
-	return strings.Split(string(idsString), ","), nil
+func (s server) getMetrics(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w)
 }
 
-func (s server) searchDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	q, err := parseQuery(r.URL.Query().Get("q"))
-	if err != nil {
-		jsonResponse(w, nil, err)
-		return
+// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version string
+	commit  string
+)
+
+func (s server) getVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jsonResponse(w, r, map[string]any{
+		"version":   version,
+		"commit":    commit,
+		"goVersion": runtime.Version(),
+	}, nil)
+}
+
+func (s server) newDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if s.useNumber {
+		dec.UseNumber()
 	}
+	return dec
+}
 
-	isRange := false
-	idsArgumentCount := map[string]int{}
-	nonRangeArguments := 0
-	for _, argument := range q.ands {
-		if argument.op == "=" {
-			nonRangeArguments++
+func (s server) unmarshal(data []byte, v any) error {
+	return s.newDecoder(bytes.NewReader(data)).Decode(v)
+}
 
-			ids, err := s.lookup(fmt.Sprintf("%s=%v", strings.Join(argument.key, "."), argument.value))
-			if err != nil {
-				jsonResponse(w, nil, err)
-				return
-			}
+// Reserved key that arrays and scalars are stored under when
+// wrapNonObjects is on
+const valueKey = "_value"
 
+var errNotObject = apiError{http.StatusBadRequest, "invalid_document", errors.New("document must be a JSON object")}
+
+func (s server) decodeDocument(r io.Reader, wrap bool) (map[string]any, error) {
+	if s.strictJSON {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkStrictJSON(data)
+		if err != nil {
+			return nil, apiError{http.StatusBadRequest, "invalid_document", err}
+		}
+		r = bytes.NewReader(data)
+	}
+
+	var body any
+	err := s.newDecoder(r).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.maxDepth > 0 && depth(body) > s.maxDepth {
+		return nil, apiError{http.StatusBadRequest, "invalid_document", fmt.Errorf("Document is nested more than %d levels deep", s.maxDepth)}
+	}
+
+	if document, ok := body.(map[string]any); ok {
+		return document, nil
+	}
+
+	if !wrap {
+		return nil, errNotObject
+	}
+
+	return map[string]any{valueKey: body}, nil
+}
+
+// The decoder keeps the last of duplicate keys and stops reading after
+// the first value, this rejects both
+func checkStrictJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := checkDuplicateKeys(dec)
+	if err != nil {
+		return err
+	}
+
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("Unexpected data after the document ending at offset %d", end)
+	}
+
+	return nil
+}
+
+func checkDuplicateKeys(dec *json.Decoder) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		keys := map[string]bool{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			if keys[key.(string)] {
+				return fmt.Errorf("Duplicate key %q at offset %d", key, dec.InputOffset())
+			}
+			keys[key.(string)] = true
+
+			err = checkDuplicateKeys(dec)
+			if err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for dec.More() {
+			err = checkDuplicateKeys(dec)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	// The closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// How many levels of objects and arrays the value has, {"a": [1]} is
+// two deep
+func depth(value any) int {
+	deepest := 0
+	switch t := value.(type) {
+	case map[string]any:
+		for _, val := range t {
+			if d := depth(val); d > deepest {
+				deepest = d
+			}
+		}
+	case []any:
+		for _, val := range t {
+			if d := depth(val); d > deepest {
+				deepest = d
+			}
+		}
+	default:
+		return 0
+	}
+
+	return deepest + 1
+}
+
+type pathValue struct {
+	path  string
+	value any
+}
+
+// Scalar array elements are included under the array's path. Keys are
+// visited in sorted order so the result is deterministic.
+func getPathValuePairs(obj map[string]any, prefix string) []pathValue {
+	var keys []string
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pvs []pathValue
+	for _, key := range keys {
+		val := obj[key]
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch t := val.(type) {
+		case map[string]any:
+			pvs = append(pvs, getPathValuePairs(t, key)...)
+			continue
+		case []any:
+			// Scalar elements are indexed under the array's path,
+			// nested objects and arrays aren't
+			for _, element := range t {
+				switch element.(type) {
+				case map[string]any, []any:
+					continue
+				}
+
+				pvs = append(pvs, pathValue{key, element})
+			}
+			continue
+		}
+
+		pvs = append(pvs, pathValue{key, val})
+	}
+
+	return pvs
+}
+
+func getPathValues(obj map[string]any, prefix string) []string {
+	var pvs []string
+	for _, pv := range getPathValuePairs(obj, prefix) {
+		pvs = append(pvs, indexKey(pv.path, pv.value))
+	}
+
+	return pvs
+}
+
+// Backslash escapes '=' and '\' so the first unescaped '=' always
+// separates the path from the value
+var indexKeyEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`)
+
+func escapeIndexKey(s string) string {
+	return indexKeyEscaper.Replace(s)
+}
+
+func unescapeIndexKey(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, c := range s {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+
+		escaped = false
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// The path part of a path-value index key
+func indexKeyPath(key string) string {
+	escaped := false
+	for i, c := range key {
+		if c == '=' && !escaped {
+			return unescapeIndexKey(key[:i])
+		}
+
+		escaped = c == '\\' && !escaped
+	}
+
+	return unescapeIndexKey(key)
+}
+
+// The key a path-value is indexed under
+func indexKey(path string, value any) string {
+	return escapeIndexKey(path) + "=" + escapeIndexKey(fmt.Sprintf("%v", value))
+}
+
+// Token index keys are kept apart from path-value keys so they don't
+// show up as values of the field
+const tokenKeyPrefix = "\x00token\x00"
+
+func tokenKey(path string, token string) string {
+	return tokenKeyPrefix + indexKey(path, token)
+}
+
+// Bucket keys hold the ids of documents with a value in [start,
+// start+width) of the field
+const bucketKeyPrefix = "\x00bucket\x00"
+
+func bucketKey(path string, value float64, width float64) string {
+	return bucketKeyPrefix + indexKey(path, strconv.FormatFloat(math.Floor(value/width)*width, 'g', -1, 64))
+}
+
+// Parses a comma separated list of path=width, e.g. price=100,age=10
+func parseBuckets(buckets string) (map[string]float64, error) {
+	parsed := map[string]float64{}
+	for _, bucket := range strings.Split(buckets, ",") {
+		if bucket == "" {
+			continue
+		}
+
+		path, width, ok := strings.Cut(bucket, "=")
+		w, err := strconv.ParseFloat(width, 64)
+		if !ok || err != nil || !(w > 0) || math.IsInf(w, 1) {
+			return nil, fmt.Errorf("Expected path=width with a positive width, got: %s", bucket)
+		}
+
+		parsed[path] = w
+	}
+
+	return parsed, nil
+}
+
+// Splits on anything that isn't a letter, digit or combining mark and
+// case-folds
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c) && !unicode.IsMark(c)
+	})
+}
+
+func (s server) isTokenized(path string) bool {
+	return s.tokenizedFields["*"] || s.tokenizedFields[path]
+}
+
+// Parses a comma separated list of dotted paths
+func parseFields(fields string) map[string]bool {
+	parsed := map[string]bool{}
+	for _, field := range strings.Split(fields, ",") {
+		if field != "" {
+			parsed[field] = true
+		}
+	}
+
+	return parsed
+}
+
+// Whether the path is one of the fields or under one of them
+func coveredBy(path string, fields map[string]bool) bool {
+	for field := range fields {
+		if path == field || hasPathPrefix(path, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s server) isIndexed(path string) bool {
+	if s.maxCardinality > 0 && s.cardinality.get(path) > s.maxCardinality {
+		return false
+	}
+
+	if len(s.indexInclude) > 0 {
+		return coveredBy(path, s.indexInclude)
+	}
+
+	return !coveredBy(path, s.indexExclude)
+}
+
+// Distinct values indexed per field are stored under this prefix in
+// the index database
+const cardinalityKeyPrefix = "\x00meta\x00cardinality\x00"
+
+// Ids of inserted documents are appended under this prefix followed
+// by a big-endian sequence number so they can be read back in
+// insertion order
+const insertionKeyPrefix = "\x00meta\x00insertion\x00"
+
+func insertionKey(sequence uint64) []byte {
+	key := make([]byte, len(insertionKeyPrefix)+8)
+	copy(key, insertionKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(insertionKeyPrefix):], sequence)
+	return key
+}
+
+func insertionBounds() *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: []byte(insertionKeyPrefix),
+		UpperBound: []byte(strings.TrimSuffix(insertionKeyPrefix, "\x00") + "\x01"),
+	}
+}
+
+func (s server) lastInsertion() (uint64, error) {
+	iter := s.indexDb.NewIter(insertionBounds())
+	defer iter.Close()
+
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+
+	return binary.BigEndian.Uint64(iter.Key()[len(insertionKeyPrefix):]), nil
+}
+
+// Documents stored before the insertion log existed are added to it in
+// order of creation
+func (s server) backfillInsertions() error {
+	type created struct {
+		id   string
+		time time.Time
+	}
+
+	var documents []created
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		// A corrupt document shouldn't keep the server from starting
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil {
+			log.Printf("Skipping unreadable document [%#v]: %s", string(iter.Key()), err)
+			continue
+		}
+
+		str, _ := document[createdKey].(string)
+		t, _ := parseTime(str)
+		documents = append(documents, created{string(iter.Key()), t})
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(documents, func(i, j int) bool {
+		return documents[i].time.Before(documents[j].time)
+	})
+
+	batch := s.indexDb.NewBatch()
+	defer batch.Close()
+	for _, document := range documents {
+		*s.insertions++
+		err := batch.Set(insertionKey(*s.insertions), []byte(document.id), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Commit(pebble.Sync)
+}
+
+// Calls f with each id in the insertion log in order, until f returns
+// false. Ids inserted again after being deleted are only passed once,
+// at their first insertion.
+func (s server) eachInsertion(f func(id string) (bool, error)) error {
+	iter := s.indexDb.NewIter(insertionBounds())
+	defer iter.Close()
+
+	seen := map[string]bool{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		id := string(iter.Value())
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		more, err := f(id)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Counts of distinct values indexed per field so fields with too many
+// can stop being indexed
+type fieldCardinality struct {
+	mu     sync.RWMutex
+	counts map[string]int64
+}
+
+func newFieldCardinality() *fieldCardinality {
+	return &fieldCardinality{counts: map[string]int64{}}
+}
+
+func (c *fieldCardinality) load(db *pebble.DB) error {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(cardinalityKeyPrefix),
+		// '\x01' sorts right after the prefix's trailing '\x00'
+		UpperBound: []byte(strings.TrimSuffix(cardinalityKeyPrefix, "\x00") + "\x01"),
+	})
+	defer iter.Close()
+
+	c.reset()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for iter.First(); iter.Valid(); iter.Next() {
+		count, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		c.counts[strings.TrimPrefix(string(iter.Key()), cardinalityKeyPrefix)] = count
+	}
+
+	return iter.Error()
+}
+
+func (c *fieldCardinality) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = map[string]int64{}
+}
+
+func (c *fieldCardinality) add(path string, delta int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[path] += delta
+	return c.counts[path]
+}
+
+func (c *fieldCardinality) get(path string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.counts[path]
+}
+
+// The highest count of any field
+func (c *fieldCardinality) max() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var max int64
+	for _, count := range c.counts {
+		if count > max {
+			max = count
+		}
+	}
+	return max
+}
+
+// Whether the index can answer equality on the query key
+func (s server) isIndexedKey(key []string) bool {
+	if isIdKey(key) {
+		return true
+	}
+
+	// Wildcards could cover fields that aren't indexed
+	if _, ok := wildcardPrefix(key); ok {
+		return s.indexesEverything()
+	}
+
+	return s.isIndexed(strings.Join(key, "."))
+}
+
+// Whether every field is indexed
+func (s server) indexesEverything() bool {
+	capped := s.maxCardinality > 0 && s.cardinality.max() > s.maxCardinality
+	return len(s.indexInclude) == 0 && len(s.indexExclude) == 0 && !capped && s.maxIndexedLength == 0
+}
+
+// Whether the value is a string too long to be indexed as is
+func (s server) tooLongToIndex(value any) bool {
+	str, ok := value.(string)
+	if !ok || s.maxIndexedLength == 0 {
+		return false
+	}
+
+	if s.normalize {
+		str = norm.NFC.String(str)
+	}
+	return len(str) > s.maxIndexedLength
+}
+
+// Every index key the document should be found under
+func (s server) indexKeys(document map[string]any) []string {
+	var pvs []pathValue
+	for _, pv := range getPathValuePairs(document, "") {
+		if s.isIndexed(pv.path) {
+			pvs = append(pvs, pv)
+		}
+	}
+
+	var keys []string
+	for i, pv := range pvs {
+		// Typed values are indexed in canonical form, values that
+		// don't fit the type are indexed as is
+		if kind, ok := s.schema[pv.path]; ok {
+			if value, ok := coerce(kind, pv.value); ok {
+				pvs[i].value = value
+				pv.value = value
+			}
+		}
+
+		// Long strings are still tokenized
+		if s.tooLongToIndex(pv.value) {
+			continue
+		}
+
+		keys = append(keys, indexKey(pv.path, pv.value))
+	}
+
+	for _, pv := range pvs {
+		str, ok := pv.value.(string)
+		if !ok || !s.isTokenized(pv.path) {
+			continue
+		}
+
+		if s.normalize {
+			str = norm.NFC.String(str)
+		}
+
+		seen := map[string]bool{}
+		for _, token := range tokenize(str) {
+			if !seen[token] {
+				seen[token] = true
+				keys = append(keys, tokenKey(pv.path, token))
+			}
+		}
+	}
+
+	for _, pv := range pvs {
+		width, ok := s.buckets[pv.path]
+		if !ok || s.schema[pv.path] == "date" {
+			continue
+		}
+
+		if f, ok := toFloat(pv.value); ok {
+			keys = append(keys, bucketKey(pv.path, f, width))
+		}
+	}
+
+	if s.normalize {
+		for i, key := range keys {
+			keys[i] = norm.NFC.String(key)
+		}
+	}
+
+	return keys
+}
+
+func (s server) index(id string, document map[string]any) {
+	s.updateIndex(indexOp{id: id, add: s.indexKeys(document)})
+}
+
+func (s server) unindex(id string, document map[string]any) {
+	s.updateIndex(indexOp{id: id, remove: s.indexKeys(document)})
+}
+
+// Removes then adds the id to the postings of the index keys
+type indexOp struct {
+	id     string
+	add    []string
+	remove []string
+}
+
+func (s server) updateIndex(op indexOp) {
+	if s.indexWriter != nil {
+		s.indexWriter.ops <- op
+		return
+	}
+
+	s.applyIndexOps([]indexOp{op})
+}
+
+// Binary postings start with this byte followed by 16 bytes per id.
+// Text postings are comma separated ids and never start with it, so
+// indexes written in either format can be read.
+const binaryPostingsFormat = 0x01
+
+func encodePostings(ids []string, binary bool) []byte {
+	if binary {
+		bs := []byte{binaryPostingsFormat}
+		for _, id := range ids {
+			parsed, err := uuid.Parse(id)
+			if err != nil || parsed.String() != id {
+				// Only canonical uuids round-trip
+				binary = false
+				break
+			}
+
+			bs = append(bs, parsed[:]...)
+		}
+
+		if binary {
+			return bs
+		}
+	}
+
+	return []byte(strings.Join(ids, ","))
+}
+
+func decodePostings(bs []byte) []string {
+	if len(bs) == 0 {
+		return nil
+	}
+
+	if bs[0] != binaryPostingsFormat {
+		return strings.Split(string(bs), ",")
+	}
+
+	var ids []string
+	for i := 1; i+16 <= len(bs); i += 16 {
+		id, _ := uuid.FromBytes(bs[i : i+16])
+		ids = append(ids, id.String())
+	}
+
+	return ids
+}
+
+// Sorts the ids and drops duplicates, in place
+func sortedUnique(ids []string) []string {
+	sort.Strings(ids)
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// Ids are added to postings by merging them onto the key rather than
+// reading and rewriting it. Pebble combines the values when the key is
+// read or compacted, into sorted postings without duplicates in the
+// format of the newest value. This replaces Pebble's default merger
+// under the same name so existing indexes, which never merged, open.
+var postingsMerger = &pebble.Merger{
+	Name: pebble.DefaultMerger.Name,
+	Merge: func(key, value []byte) (pebble.ValueMerger, error) {
+		return &postingsValueMerger{newer: [][]byte{append([]byte(nil), value...)}}, nil
+	},
+}
+
+type postingsValueMerger struct {
+	// Newest first
+	older [][]byte
+	// Oldest first
+	newer [][]byte
+}
+
+func (m *postingsValueMerger) MergeNewer(value []byte) error {
+	m.newer = append(m.newer, append([]byte(nil), value...))
+	return nil
+}
+
+func (m *postingsValueMerger) MergeOlder(value []byte) error {
+	m.older = append(m.older, append([]byte(nil), value...))
+	return nil
+}
+
+func (m *postingsValueMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	var ids []string
+	for _, value := range m.older {
+		ids = append(ids, decodePostings(value)...)
+	}
+	for _, value := range m.newer {
+		ids = append(ids, decodePostings(value)...)
+	}
+
+	newest := m.newer[len(m.newer)-1]
+	binary := len(newest) > 0 && newest[0] == binaryPostingsFormat
+	return encodePostings(sortedUnique(ids), binary), nil, nil
+}
+
+// Keys of at most this many postings are remembered, the cache is
+// emptied when it fills up
+const maxCachedPostingsKeys = 10000
+
+// Index keys known to have postings, so ids can be merged onto them
+// without reading them to tell whether they add a distinct value
+type postingsKeyCache struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func newPostingsKeyCache() *postingsKeyCache {
+	return &postingsKeyCache{keys: map[string]bool{}}
+}
+
+func (c *postingsKeyCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys[key]
+}
+
+func (c *postingsKeyCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.keys) >= maxCachedPostingsKeys {
+		c.keys = map[string]bool{}
+	}
+	c.keys[key] = true
+}
+
+func (c *postingsKeyCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.keys, key)
+}
+
+func (c *postingsKeyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = map[string]bool{}
+}
+
+// Applies the ops in order, reading and writing each index key once.
+// Ids added to keys known to have postings are merged onto them
+// without reading them, only removals and new keys read and rewrite
+// the postings.
+func (s server) applyIndexOps(ops []indexOp) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	postings := map[string][]string{}
+	existed := map[string]bool{}
+	// Ids to merge onto keys whose postings haven't been read
+	appends := map[string][]string{}
+	var keys []string
+	get := func(key string) []string {
+		ids, ok := postings[key]
+		if ok {
+			return ids
+		}
+
+		ids, err := s.lookup(key)
+		if err != nil {
+			log.Print(err)
+		}
+		if pending, ok := appends[key]; ok {
+			ids = sortedUnique(append(ids, pending...))
+			delete(appends, key)
+		} else {
+			keys = append(keys, key)
+			existed[key] = len(ids) > 0
+		}
+		return ids
+	}
+
+	for _, op := range ops {
+		for _, key := range op.remove {
+			var remaining []string
+			for _, existingId := range get(key) {
+				if op.id != existingId {
+					remaining = append(remaining, existingId)
+				}
+			}
+			postings[key] = remaining
+		}
+
+		for _, key := range op.add {
+			if _, read := postings[key]; !read && (appends[key] != nil || s.postingsKeys.has(key)) {
+				if appends[key] == nil {
+					keys = append(keys, key)
+					existed[key] = true
+				}
+				appends[key] = append(appends[key], op.id)
+				continue
+			}
+
+			ids := get(key)
+
+			// Postings are kept sorted so searches can read ids in
+			// order
+			i := sort.SearchStrings(ids, op.id)
+			if i == len(ids) || ids[i] != op.id {
+				ids = append(ids, "")
+				copy(ids[i+1:], ids[i:])
+				ids[i] = op.id
+			}
+			postings[key] = ids
+		}
+	}
+
+	batch := s.indexDb.NewBatch()
+	distinct := map[string]int64{}
+	for _, key := range keys {
+		if ids, ok := appends[key]; ok {
+			err := batch.Merge([]byte(key), encodePostings(sortedUnique(ids), s.binaryPostings), nil)
+			if err != nil {
+				log.Printf("Could not update index: %s", err)
+			}
+			continue
+		}
+
+		var err error
+		if len(postings[key]) == 0 {
+			err = batch.Delete([]byte(key), nil)
+			s.postingsKeys.remove(key)
+		} else {
+			err = batch.Set([]byte(key), encodePostings(postings[key], s.binaryPostings), nil)
+			s.postingsKeys.add(key)
+		}
+		if err != nil {
+			log.Printf("Could not update index: %s", err)
+		}
+
+		// Track how many distinct values each field has, token and
+		// bucket keys aren't values
+		if strings.HasPrefix(key, tokenKeyPrefix) || strings.HasPrefix(key, bucketKeyPrefix) || existed[key] == (len(postings[key]) > 0) {
+			continue
+		}
+		if existed[key] {
+			distinct[indexKeyPath(key)]--
+		} else {
+			distinct[indexKeyPath(key)]++
+		}
+	}
+
+	for path, delta := range distinct {
+		count := s.cardinality.add(path, delta)
+		err := batch.Set([]byte(cardinalityKeyPrefix+path), []byte(strconv.FormatInt(count, 10)), nil)
+		if err != nil {
+			log.Printf("Could not update index: %s", err)
+		}
+
+		if s.maxCardinality > 0 && count-delta <= s.maxCardinality && count > s.maxCardinality {
+			log.Printf("Field %s has more than %d distinct values, no longer indexing it", path, s.maxCardinality)
+
+			// Updates stop maintaining the field's postings, so they
+			// would go stale. '>' sorts right after '='.
+			for _, prefix := range []string{"", tokenKeyPrefix, bucketKeyPrefix} {
+				err = batch.DeleteRange([]byte(prefix+escapeIndexKey(path)+"="), []byte(prefix+escapeIndexKey(path)+">"), nil)
+				if err != nil {
+					log.Printf("Could not update index: %s", err)
+				}
+			}
+			s.postingsKeys.reset()
+		}
+	}
+
+	// Without syncing the index can lag the documents after a crash,
+	// which the next startup repairs by reindexing
+	opts := pebble.NoSync
+	if s.indexSync {
+		opts = pebble.Sync
+	}
+
+	err := batch.Commit(opts)
+	if err != nil {
+		log.Printf("Could not update index: %s", err)
+		s.postingsKeys.reset()
+	}
+	s.cache.invalidate()
+}
+
+// The most search responses cached at once, past which the cache
+// starts over
+const maxCachedResults = 1000
+
+type cachedResult struct {
+	generation uint64
+	expires    time.Time
+	body       map[string]any
+}
+
+// Caches search responses for up to ttl. Every write bumps the
+// generation, which drops every entry, and a search racing a write
+// isn't cached since it may not have seen it. A nil cache caches
+// nothing.
+type resultCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	generation uint64
+	entries    map[string]cachedResult
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, entries: map[string]cachedResult{}}
+}
+
+// Params that only change how the response is written, not what's in
+// it, are left out of the key
+func resultCacheKey(params url.Values) string {
+	key := url.Values{}
+	for name, values := range params {
+		if name != "pretty" && name != "raw" {
+			key[name] = values
+		}
+	}
+
+	return key.Encode()
+}
+
+func (c *resultCache) get(key string) (map[string]any, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[key]
+	if ok && time.Now().After(cached.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return cached.body, c.generation, ok
+}
+
+func (c *resultCache) put(key string, generation uint64, body map[string]any) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+
+	if len(c.entries) >= maxCachedResults {
+		c.entries = map[string]cachedResult{}
+	}
+	c.entries[key] = cachedResult{generation, time.Now().Add(c.ttl), body}
+}
+
+func (c *resultCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = map[string]cachedResult{}
+}
+
+// Applies index updates in the background, coalescing the updates
+// made within window of each other into one write per index key.
+type indexWriter struct {
+	s       server
+	window  time.Duration
+	ops     chan indexOp
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+func newIndexWriter(s server, window time.Duration) *indexWriter {
+	w := &indexWriter{
+		s:       s,
+		window:  window,
+		ops:     make(chan indexOp, 1024),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *indexWriter) run() {
+	var pending []indexOp
+	var timer <-chan time.Time
+	apply := func() {
+		if len(pending) > 0 {
+			w.s.applyIndexOps(pending)
+		}
+		pending = nil
+		timer = nil
+	}
+
+	for {
+		select {
+		case op, ok := <-w.ops:
+			if !ok {
+				apply()
+				close(w.done)
+				return
+			}
+
+			pending = append(pending, op)
+			if timer == nil {
+				timer = time.After(w.window)
+			}
+		case <-timer:
+			apply()
+		case flushed := <-w.flushes:
+			// Pick up everything queued before the flush
+		drain:
+			for {
+				select {
+				case op := <-w.ops:
+					pending = append(pending, op)
+				default:
+					break drain
+				}
+			}
+
+			apply()
+			close(flushed)
+		}
+	}
+}
+
+// Waits until every update queued before the call has been applied
+func (w *indexWriter) flush() {
+	flushed := make(chan struct{})
+	w.flushes <- flushed
+	<-flushed
+}
+
+// Applies the remaining updates and stops the writer
+func (w *indexWriter) close() {
+	close(w.ops)
+	<-w.done
+}
+
+// Timestamps are stored in the document body under reserved keys so
+// they are indexed and can be queried and sorted like any other field.
+const (
+	createdKey = "_created"
+	updatedKey = "_updated"
+)
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// Soft deleted documents are kept with this set to true and removed
+// from the index until they are purged
+const deletedKey = "_deleted"
+
+func isDeleted(document map[string]any) bool {
+	deleted, _ := document[deletedKey].(bool)
+	return deleted
+}
+
+// Generates UUIDv7s, which start with a millisecond timestamp so they
+// sort in creation order. Ids made within the same millisecond
+// increment a counter in the 12 bits after the timestamp so they're
+// ordered too.
+type uuidV7Generator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	counter uint16
+}
+
+func (g *uuidV7Generator) new(now time.Time) (uuid.UUID, error) {
+	var id uuid.UUID
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return id, err
+	}
+
+	g.mu.Lock()
+	ms := now.UnixMilli()
+	if ms <= g.lastMs {
+		g.counter++
+		// Borrow from the next millisecond when the counter overflows
+		if g.counter > 0xfff {
+			g.lastMs++
+			g.counter = 0
+		}
+		ms = g.lastMs
+	} else {
+		g.lastMs = ms
+		g.counter = 0
+	}
+	counter := g.counter
+	g.mu.Unlock()
+
+	id[0] = byte(ms >> 40)
+	id[1] = byte(ms >> 32)
+	id[2] = byte(ms >> 24)
+	id[3] = byte(ms >> 16)
+	id[4] = byte(ms >> 8)
+	id[5] = byte(ms)
+	id[6] = 0x70 | byte(counter>>8) // Version 7
+	id[7] = byte(counter)
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+
+	return id, nil
+}
+
+func (s server) newId() string {
+	if s.uuidV7 == nil {
+		return uuid.New().String()
+	}
+
+	id, err := s.uuidV7.new(time.Now())
+	if err != nil {
+		// Same as uuid.New, failing to read randomness isn't
+		// recoverable
+		panic(err)
+	}
+	return id.String()
+}
+
+// Writes go through the write-ahead log when it is enabled
+func (s server) setDocument(id string, bs []byte) error {
+	defer s.cache.invalidate()
+	s.metrics.observeDocumentSize(len(bs))
+	return s.logged([]walEntry{{Op: walSet, Id: id, Document: bs}}, func() error {
+		return s.db.Set([]byte(id), bs, pebble.Sync)
+	})
+}
+
+// Marshals the document as it will be stored, rejecting it if that's
+// too large
+func (s server) encodeDocument(document map[string]any) ([]byte, error) {
+	bs, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.maxDocumentSize > 0 && len(bs) > s.maxDocumentSize {
+		return nil, apiError{http.StatusBadRequest, "invalid_document", fmt.Errorf("Document is %d bytes, more than the maximum of %d", len(bs), s.maxDocumentSize)}
+	}
+
+	return bs, nil
+}
+
+func (s server) removeDocument(id string) error {
+	defer s.cache.invalidate()
+	return s.logged([]walEntry{{Op: walDelete, Id: id}}, func() error {
+		return s.db.Delete([]byte(id), pebble.Sync)
+	})
+}
+
+func (s server) logged(entries []walEntry, apply func() error) error {
+	if s.wal == nil {
+		return apply()
+	}
+
+	return s.wal.write(entries, apply)
+}
+
+func (s server) addDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	document, err := s.decodeDocument(r.Body, s.wrapNonObjects)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	// Conditional inserts are serialized so two of them can't both
+	// miss each other's document. Other writes aren't, so they can
+	// still make a document match in between.
+	if unless := r.URL.Query().Get("unlessExists"); unless != "" {
+		s.insertLock.Lock()
+		defer s.insertLock.Unlock()
+
+		existing, err := s.firstMatch(unless)
+		if err != nil {
+			jsonResponse(w, r, nil, err)
+			return
+		}
+
+		if existing != "" {
+			jsonResponse(w, r, map[string]any{"id": existing}, apiError{http.StatusConflict, "conflict", fmt.Errorf("A document matching unlessExists already exists: %s", existing)})
+			return
+		}
+	}
+
+	// New unique id for the document
+	id := s.newId()
+
+	err = s.insertDocument(id, document, r.Header.Get("X-Skip-Index") == "true")
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"id": id,
+	}, nil)
+}
+
+// The id of the first document matching the query, or "" if none do
+func (s server) firstMatch(q string) (string, error) {
+	parsed, err := s.parseQuery(q)
+	if err != nil {
+		return "", err
+	}
+
+	// Queued index updates could hide a match
+	if s.indexWriter != nil {
+		s.indexWriter.flush()
+	}
+
+	plan, err := s.planQuery(parsed, false)
+	if err == nil {
+		err = s.checkScan(plan)
+	}
+	if err != nil {
+		return "", err
+	}
+	plan.limit = 1
+
+	results, _, err := s.search(parsed, plan)
+	if err != nil || len(results) == 0 {
+		return "", err
+	}
+
+	return results[0].id, nil
+}
+
+func (s server) insertDocument(id string, document map[string]any, skipIndex bool) error {
+	now := timestamp()
+	document[createdKey] = now
+	document[updatedKey] = now
+
+	bs, err := s.encodeDocument(document)
+	if err != nil {
+		return err
+	}
+
+	if s.lazyIndex || skipIndex {
+		// Searches scan until the next reindex
+		atomic.AddInt64(s.unindexed, 1)
+	} else {
+		s.index(id, document)
+	}
+
+	err = s.setDocument(id, bs)
+	if err != nil {
+		return err
+	}
+
+	err = s.indexDb.Set(insertionKey(atomic.AddUint64(s.insertions, 1)), []byte(id), pebble.Sync)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.metrics.inserts, 1)
+	atomic.AddInt64(&s.metrics.documents, 1)
+	return nil
+}
+
+// Ids end up in comma separated postings and in URL paths. A leading
+// control character could be mistaken for a meta key or the binary
+// postings marker.
+func validateId(id string) error {
+	if id == "" || strings.ContainsAny(id, ",/") || id[0] < ' ' || id[0] == 0x7f {
+		return fmt.Errorf("Expected a non-empty id without commas, slashes or a leading control character, got: %q", id)
+	}
+
+	return nil
+}
+
+// Upserts newline delimited JSON documents. Lines with an id field
+// (_id unless idField is given) replace the document with that id or
+// insert it under that id, lines without one are inserted with a new
+// id. Lines that fail are reported without stopping the import.
+func (s server) importDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	idField := r.URL.Query().Get("idField")
+	if idField == "" {
+		idField = "_id"
+	}
+
+	inserted, updated := 0, 0
+	lineErrors := []map[string]any{}
+	upsert := func(line []byte) error {
+		document, err := s.decodeDocument(bytes.NewReader(line), s.wrapNonObjects)
+		if err != nil {
+			return err
+		}
+
+		id := s.newId()
+		if value, ok := document[idField]; ok {
+			id, ok = value.(string)
+			if !ok {
+				return fmt.Errorf("Expected %s to be a string", idField)
+			}
+
+			err = validateId(id)
+			if err != nil {
+				return err
+			}
+
+			// Only the reserved key is stripped, another id field is
+			// part of the document
+			if idField == "_id" {
+				delete(document, idField)
+			}
+
+			// Like PUT, deleted documents aren't brought back
+			old, err := s.getDocumentById([]byte(id))
+			if err == nil && isDeleted(old) {
+				return errNotFound(id)
+			}
+			if err == nil {
+				err = s.updateDocument(id, old, document)
+				if err == nil {
+					updated++
+				}
+				return err
+			}
+
+			if !isNotFound(err) {
+				return err
+			}
+		}
+
+		err = s.insertDocument(id, document, false)
+		if err == nil {
+			inserted++
+		}
+		return err
+	}
+
+	reader := bufio.NewReader(r.Body)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			jsonResponse(w, r, nil, err)
+			return
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			if upsertErr := upsert(line); upsertErr != nil {
+				lineErrors = append(lineErrors, map[string]any{"line": lineNumber, "error": upsertErr.Error()})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"inserted": inserted,
+		"updated":  updated,
+		"errors":   lineErrors,
+	}, nil)
+}
+
+type queryComparison struct {
+	key   []string
+	value string
+	op    string
+	// Equality matches if every token of the value is a token of the
+	// field
+	tokenized bool
+	// Compare in Unicode normal form C
+	normalize bool
+	// The value is canonical JSON of an object to compare structurally
+	object bool
+	// Range operators compare strings byte-wise instead of as numbers
+	// or timestamps
+	lexical bool
+	// Every element of an array must match rather than any
+	all bool
+	// Compiled from value for regular expression matches
+	pattern *regexp.Regexp
+	// Matches any value at or under the key, e.g. address:*
+	exists bool
+	// Compares against the value at another path of the same document
+	// rather than a literal, e.g. a:>@b
+	field []string
+	// Type from the schema both sides are coerced to before comparing,
+	// the value is already in canonical form
+	kind string
+	// Compares the number of elements of the array rather than their
+	// values, e.g. tags:count>2
+	count bool
+	// The JSON type the value must have, int, float, bool or string,
+	// from e.g. qty:int(3). The value is already in canonical form.
+	literal string
+	// Documents missing the key satisfy < and <= as if it were
+	// negative infinity, rather than never matching
+	missingLow bool
+	// Matches {"lat": ..., "lng": ...} objects within the radius of
+	// the point, e.g. location:near(42.36,-71.06,10)
+	near *geoRadius
+	// The value is a timestamp resolved from now when the query was
+	// parsed, e.g. expires:<now-1h
+	relative bool
+}
+
+type geoRadius struct {
+	lat, lng, km float64
+}
+
+// Mean radius of the Earth
+const earthRadiusKm = 6371.0088
+
+// Great-circle distance between two points by the haversine formula
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func (g geoRadius) contains(value any) bool {
+	point, ok := value.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	lat, latOk := toFloat(point["lat"])
+	lng, lngOk := toFloat(point["lng"])
+	return latOk && lngOk && haversineKm(g.lat, g.lng, lat, lng) <= g.km
+}
+
+type query struct {
+	ands []queryComparison
+	// Each group matches when any one of its alternatives matches
+	ors [][]query
+}
+
+// An empty query matches every document
+func (q query) isEmpty() bool {
+	return len(q.ands) == 0 && len(q.ors) == 0
+}
+
+// Numeric segments index into arrays, e.g. items.0.name is the name
+// of the first element of items
+func getPath(doc map[string]any, parts []string) (any, bool) {
+	var docSegment any = doc
+	for _, part := range parts {
+		if elements, ok := docSegment.([]any); ok {
+			i, ok := arrayIndex(part)
+			if !ok || i >= len(elements) {
+				return nil, false
+			}
+
+			docSegment = elements[i]
+			continue
+		}
+
+		m, ok := docSegment.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		if docSegment, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return docSegment, true
+}
+
+// A segment of only digits, as an index into an array
+func arrayIndex(part string) (int, bool) {
+	if part == "" {
+		return 0, false
+	}
+	for _, c := range part {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+
+	i, err := strconv.Atoi(part)
+	return i, err == nil
+}
+
+// Whether a segment of the key could index into an array, which the
+// index doesn't record positions for
+func hasArrayIndex(key []string) bool {
+	for _, segment := range key {
+		if _, ok := arrayIndex(segment); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The document id isn't part of the document body so it is handled as
+// a pseudo-field
+func isIdKey(key []string) bool {
+	return len(key) == 1 && key[0] == "_id"
+}
+
+func toFloat(value any) (float64, bool) {
+	switch t := value.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint8:
+		return float64(t), true
+	case uint16:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int8:
+		return float64(t), true
+	case int16:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// Accepts RFC3339 timestamps or plain dates
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Checks the comparison result against <, >, <= or >=
+func satisfies(op string, cmp int) bool {
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+
+	return false
+}
+
+// Timestamps are compared chronologically, everything else numerically
+func compareRange(value any, op string, argument string) bool {
+	if s, ok := value.(string); ok {
+		left, leftOk := parseTime(s)
+		right, rightOk := parseTime(argument)
+		if leftOk && rightOk {
+			cmp := 0
+			if left.Before(right) {
+				cmp = -1
+			} else if left.After(right) {
+				cmp = 1
+			}
+			return satisfies(op, cmp)
+		}
+	}
+
+	right, err := strconv.ParseFloat(argument, 64)
+	if err != nil {
+		return false
+	}
+
+	left, ok := toFloat(value)
+	if !ok {
+		return false
+	}
+
+	cmp := 0
+	if left < right {
+		cmp = -1
+	} else if left > right {
+		cmp = 1
+	}
+	return satisfies(op, cmp)
+}
+
+var schemaTypes = map[string]bool{"number": true, "string": true, "bool": true, "date": true}
+
+// Converts the value to the canonical string form of the type so that
+// e.g. 1, 1.0 and "1" are all the number 1
+func coerce(kind string, value any) (string, bool) {
+	switch value.(type) {
+	case map[string]any, []any:
+		return "", false
+	}
+
+	str := fmt.Sprintf("%v", value)
+	switch kind {
+	case "number":
+		f, ok := toFloat(value)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%v", f), true
+	case "bool":
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatBool(b), true
+	case "date":
+		t, ok := parseTime(str)
+		if !ok {
+			return "", false
+		}
+		return t.UTC().Format(time.RFC3339Nano), true
+	}
+
+	return str, true
+}
+
+// Compares two values in canonical form of the type, bools have no
+// order
+func compareCoerced(kind string, left string, right string) (int, bool) {
+	switch kind {
+	case "number":
+		l, _ := strconv.ParseFloat(left, 64)
+		r, _ := strconv.ParseFloat(right, 64)
+		if l < r {
+			return -1, true
+		} else if l > r {
+			return 1, true
+		}
+		return 0, true
+	case "date":
+		l, _ := time.Parse(time.RFC3339Nano, left)
+		r, _ := time.Parse(time.RFC3339Nano, right)
+		if l.Before(r) {
+			return -1, true
+		} else if l.After(r) {
+			return 1, true
+		}
+		return 0, true
+	case "string":
+		return strings.Compare(left, right), true
+	}
+
+	return 0, false
+}
+
+func containsTokens(str string, argument string) bool {
+	tokens := map[string]bool{}
+	for _, token := range tokenize(str) {
+		tokens[token] = true
+	}
+
+	wanted := tokenize(argument)
+	for _, token := range wanted {
+		if !tokens[token] {
+			return false
+		}
+	}
+
+	return len(wanted) > 0
+}
+
+// A trailing * segment in a key matches any path under the rest of
+// the key, e.g. address.* matches address.city and address.geo.lat. A
+// key of just * matches any path.
+func wildcardPrefix(key []string) (string, bool) {
+	if len(key) == 0 || key[len(key)-1] != "*" {
+		return "", false
+	}
+
+	return strings.Join(key[:len(key)-1], "."), true
+}
+
+// Whether a segment of the key has a dot in it, e.g. from a\.b.c
+func hasDottedSegment(key []string) bool {
+	for _, segment := range key {
+		if strings.Contains(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Strings aren't numbers or bools here, unlike everywhere else
+func (argument queryComparison) matchLiteral(value any) bool {
+	switch argument.literal {
+	case "int", "float":
+		var f float64
+		switch t := value.(type) {
+		case float64:
+			f = t
+		case json.Number:
+			var err error
+			if f, err = t.Float64(); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+
+		if argument.literal == "int" && f != math.Trunc(f) {
+			return false
+		}
+
+		right, _ := strconv.ParseFloat(argument.value, 64)
+		cmp := 0
+		if f < right {
+			cmp = -1
+		} else if f > right {
+			cmp = 1
+		}
+		if argument.op == "=" {
+			return cmp == 0
+		}
+		return satisfies(argument.op, cmp)
+	case "bool":
+		b, ok := value.(bool)
+		return ok && strconv.FormatBool(b) == argument.value
+	}
+
+	if _, ok := value.(string); !ok {
+		return false
+	}
+
+	argument.literal = ""
+	return argument.matchValue(value)
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	return prefix == "" || strings.HasPrefix(path, prefix+".")
+}
+
+func (argument queryComparison) matchValue(value any) bool {
+	if argument.near != nil {
+		return argument.near.contains(value)
+	}
+
+	if argument.literal != "" {
+		return argument.matchLiteral(value)
+	}
+
+	if argument.pattern != nil {
+		switch value.(type) {
+		case map[string]any, []any:
+			return false
+		}
+
+		return argument.pattern.MatchString(fmt.Sprintf("%v", value))
+	}
+
+	if argument.object {
+		if _, ok := value.(map[string]any); !ok {
+			return false
+		}
+
+		canonical, err := canonicalJSON(value)
+		return err == nil && canonical == argument.value
+	}
+
+	if argument.kind != "" {
+		str, ok := coerce(argument.kind, value)
+		if !ok {
+			return false
+		}
+
+		if argument.op != "=" {
+			cmp, ok := compareCoerced(argument.kind, str, argument.value)
+			return ok && satisfies(argument.op, cmp)
+		}
+
+		// Strings still go through normalization and tokens below
+		if argument.kind != "string" {
+			return str == argument.value
+		}
+		value = str
+	}
+
+	// Handle equality
+	if argument.op == "=" {
+		str := fmt.Sprintf("%v", value)
+		if argument.normalize {
+			str = norm.NFC.String(str)
+		}
+
+		match := str == argument.value
+		if _, ok := value.(string); ok && !match && argument.tokenized {
+			match = containsTokens(str, argument.value)
+		}
+		return match
+	}
+
+	// Handle <, >, <=, >=
+	if argument.lexical {
+		str, ok := value.(string)
+		return ok && satisfies(argument.op, strings.Compare(str, argument.value))
+	}
+
+	return compareRange(value, argument.op, argument.value)
+}
+
+// Whether the value has anything the index would find it by
+func hasValues(value any) bool {
+	switch t := value.(type) {
+	case map[string]any:
+		return len(getPathValuePairs(t, "")) > 0
+	case []any:
+		// Only scalar elements are indexed
+		for _, element := range t {
+			switch element.(type) {
+			case map[string]any, []any:
+				continue
+			}
+			return true
+		}
+		return false
+	}
+
+	return true
+}
+
+func (argument queryComparison) match(id string, doc map[string]any) bool {
+	if argument.count {
+		value, _ := getPath(doc, argument.key)
+		elements, ok := value.([]any)
+		if !ok {
+			return false
+		}
+
+		if argument.op == "=" {
+			n, err := strconv.ParseFloat(argument.value, 64)
+			return err == nil && float64(len(elements)) == n
+		}
+		return compareRange(float64(len(elements)), argument.op, argument.value)
+	}
+
+	if argument.field != nil {
+		var other any = id
+		if !isIdKey(argument.field) {
+			var ok bool
+			if other, ok = getPath(doc, argument.field); !ok {
+				return false
+			}
+		}
+
+		switch other.(type) {
+		case map[string]any, []any:
+			return false
+		}
+
+		argument.value = fmt.Sprintf("%v", other)
+		if argument.kind != "" {
+			var ok bool
+			if argument.value, ok = coerce(argument.kind, other); !ok {
+				return false
+			}
+		}
+		if argument.normalize {
+			argument.value = norm.NFC.String(argument.value)
+		}
+		argument.field = nil
+	}
+
+	if argument.exists {
+		if isIdKey(argument.key) {
+			return true
+		}
+
+		value, ok := getPath(doc, argument.key)
+		return ok && hasValues(value)
+	}
+
+	if isIdKey(argument.key) {
+		return argument.matchValue(id)
+	}
+
+	if prefix, ok := wildcardPrefix(argument.key); ok {
+		for _, pv := range getPathValuePairs(doc, "") {
+			if hasPathPrefix(pv.path, prefix) && argument.matchValue(pv.value) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	value, ok := getPath(doc, argument.key)
+	if !ok {
+		return argument.missingLow && (argument.op == "<" || argument.op == "<=")
+	}
+
+	// Scalars are treated as single element arrays
+	elements, ok := value.([]any)
+	if !ok || argument.object {
+		elements = []any{value}
+	}
+
+	if argument.all {
+		for _, element := range elements {
+			if !argument.matchValue(element) {
+				return false
+			}
+		}
+
+		return len(elements) > 0
+	}
+
+	for _, element := range elements {
+		if argument.matchValue(element) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// How many of the comparisons match, counting each alternative of an
+// OR separately so documents matching more of them score higher
+func (q query) score(id string, doc map[string]any) int {
+	score := 0
+	for _, argument := range q.ands {
+		if argument.match(id, doc) {
+			score++
+		}
+	}
+
+	for _, alternatives := range q.ors {
+		for _, alternative := range alternatives {
+			if alternative.match(id, doc) {
+				score++
+			}
+		}
+	}
+
+	return score
+}
+
+func (q query) match(id string, doc map[string]any) bool {
+	for _, argument := range q.ands {
+		if !argument.match(id, doc) {
+			return false
+		}
+	}
+
+	for _, alternatives := range q.ors {
+		matched := false
+		for _, alternative := range alternatives {
+			if alternative.match(id, doc) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handles either quoted strings or unquoted strings of only contiguous
+// digits, letters (including combining marks), dots, underscores,
+// dashes and asterisks
+func lexString(input []rune, index int) (string, int, error) {
+	if index >= len(input) {
+		return "", index, nil
+	}
+	if input[index] == '"' {
+		index++
+		foundEnd := false
+
+		var s []rune
+		for index < len(input) {
+			if input[index] == '"' {
+				foundEnd = true
+				break
+			}
+
+			// \" is a literal quote and \\ a literal backslash, other
+			// backslashes are kept as is
+			if input[index] == '\\' && index+1 < len(input) && (input[index+1] == '"' || input[index+1] == '\\') {
+				index++
+			}
+
+			s = append(s, input[index])
+			index++
+		}
+
+		if !foundEnd {
+			return "", index, fmt.Errorf("Expected end of quoted string")
+		}
+
+		return string(s), index + 1, nil
+	}
+
+	// If unquoted, read as much contiguous digits/letters as there are
+	var s []rune
+	var c rune
+	// TODO: someone needs to validate there's not ...
+	for index < len(input) {
+		c = input[index]
+		// A backslash makes the next character part of the string,
+		// e.g. url:http\://x
+		if c == '\\' && index+1 < len(input) {
+			s = append(s, input[index+1])
+			index += 2
+			continue
+		}
+
+		if !isUnquotedRune(c) {
+			break
+		}
+		s = append(s, c)
+		index++
+	}
+
+	if len(s) == 0 {
+		return "", index, fmt.Errorf("No string found")
+	}
+
+	return string(s), index, nil
+}
+
+// Lexes a key, quoted or not, into its dot separated segments. A
+// backslash escaped dot is part of a segment, e.g. a\.b.c is the key
+// a.b and then c.
+func lexKey(input []rune, index int) ([]string, int, error) {
+	start := index
+	quoted := index < len(input) && input[index] == '"'
+	if quoted {
+		index++
+	}
+
+	segments := []string{}
+	var segment []rune
+	for index < len(input) {
+		c := input[index]
+		if quoted && c == '"' {
+			break
+		}
+
+		// In quotes only \", \\ and \. are escapes
+		if c == '\\' && index+1 < len(input) && (!quoted || strings.ContainsRune(`"\.`, input[index+1])) {
+			segment = append(segment, input[index+1])
+			index += 2
+			continue
+		}
+
+		if c == '.' {
+			segments = append(segments, string(segment))
+			segment = nil
+			index++
+			continue
+		}
+
+		if !quoted && !isUnquotedRune(c) {
+			break
+		}
+		segment = append(segment, c)
+		index++
+	}
+	segments = append(segments, string(segment))
+
+	if quoted {
+		if index >= len(input) {
+			return nil, index, fmt.Errorf("Expected end of quoted string")
+		}
+
+		return segments, index + 1, nil
+	}
+
+	if index == start {
+		return nil, index, fmt.Errorf("No string found")
+	}
+
+	return segments, index, nil
+}
+
+// Characters that can be part of an unquoted string
+func isUnquotedRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c) || c == '.' || c == '_' || c == '-' || c == '+' || c == '*' || c == '/'
+}
+
+// Checks for count immediately followed by a comparison operator
+func isCount(qRune []rune, index int) bool {
+	end := index + len("count")
+	return end < len(qRune) && string(qRune[index:end]) == "count" && strings.ContainsRune("<>=", qRune[end])
+}
+
+// Formats the value of a typed literal the way the index formats
+// values of that type
+func canonicalLiteral(literal string, value string) (string, error) {
+	switch literal {
+	case "int":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", float64(i)), nil
+	case "float":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", f), nil
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+	}
+
+	return value, nil
+}
+
+// Checks for name immediately followed by an opening parenthesis
+func isCall(qRune []rune, index int, name string) bool {
+	end := index + len(name)
+	return end < len(qRune) && string(qRune[index:end]) == name && qRune[end] == '('
+}
+
+// Lexes a comma separated list of strings in parentheses, e.g. (18, 65)
+func lexArguments(qRune []rune, index int) ([]string, int, error) {
+	arguments, _, nextIndex, err := lexQuotedArguments(qRune, index)
+	return arguments, nextIndex, err
+}
+
+// Like lexArguments but also reports which arguments were quoted
+func lexQuotedArguments(qRune []rune, index int) ([]string, []bool, int, error) {
+	// Skip the opening parenthesis
+	index++
+
+	var arguments []string
+	var quoted []bool
+	for {
+		for index < len(qRune) && unicode.IsSpace(qRune[index]) {
+			index++
+		}
+
+		quoted = append(quoted, index < len(qRune) && qRune[index] == '"')
+		argument, nextIndex, err := lexString(qRune, index)
+		if err != nil {
+			return nil, nil, nextIndex, fmt.Errorf("Expected valid argument, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+		}
+		arguments = append(arguments, argument)
+		index = nextIndex
+
+		for index < len(qRune) && unicode.IsSpace(qRune[index]) {
+			index++
+		}
+
+		if index < len(qRune) && qRune[index] == ',' {
+			index++
+			continue
+		}
+
+		if index < len(qRune) && qRune[index] == ')' {
+			return arguments, quoted, index + 1, nil
+		}
+
+		return nil, nil, index, fmt.Errorf("Expected comma or closing parenthesis at %d", index)
+	}
+}
+
+// E.g. a.b:12, age:between(18,65) or status:active|pending
+func parseComparison(qRune []rune, i int, defaultKey []string) (query, int, error) {
+	path, nextIndex, err := lexKey(qRune, i)
+
+	// A value without a key, e.g. foo, compares against the default
+	// key when there is one
+	if defaultKey != nil && (err != nil || nextIndex >= len(qRune) || qRune[nextIndex] != ':') {
+		value, nextIndex, err := lexString(qRune, i)
+		if err == nil && nextIndex == i {
+			err = fmt.Errorf("No string found")
+		}
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected valid key or value, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+		}
+
+		// Keys are rewritten in place later so each gets its own
+		key := append([]string(nil), defaultKey...)
+		return query{ands: []queryComparison{{key: key, value: value, op: "="}}}, nextIndex, nil
+	}
+
+	if err != nil {
+		return query{}, nextIndex, fmt.Errorf("Expected valid key, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+	}
+
+	if nextIndex >= len(qRune) || qRune[nextIndex] != ':' {
+		return query{}, nextIndex, fmt.Errorf("Expected colon at %d, got: `%s`", nextIndex, string(qRune[nextIndex:]))
+	}
+	i = nextIndex + 1
+
+	// A leading ~ makes range operators compare strings lexically
+	lexical := false
+	if i < len(qRune) && qRune[i] == '~' {
+		lexical = true
+		i++
+	}
+
+	op := "="
+	if i < len(qRune) && (qRune[i] == '>' || qRune[i] == '<') {
+		op = string(qRune[i])
+		i++
+		if i < len(qRune) && qRune[i] == '=' {
+			op += "="
+			i++
+		}
+	}
+
+	// Inclusive range, sugar for >= and <=
+	if op == "=" && isCall(qRune, i, "between") {
+		bounds, quoted, nextIndex, err := lexQuotedArguments(qRune, i+len("between"))
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		if len(bounds) != 2 {
+			return query{}, nextIndex, fmt.Errorf("Expected two arguments to between at %d, got %d", i, len(bounds))
+		}
+
+		// Unquoted now bounds are relative like they are for < and >,
+		// e.g. _created:between(now-1d,now)
+		ands := []queryComparison{
+			{key: path, value: bounds[0], op: ">=", lexical: lexical},
+			{key: path, value: bounds[1], op: "<=", lexical: lexical},
+		}
+		for j := range ands {
+			if lexical || quoted[j] || !isNow(bounds[j]) {
+				continue
+			}
+
+			at, err := resolveNow(bounds[j], time.Now())
+			if err != nil {
+				return query{}, nextIndex, fmt.Errorf("Expected now, now+duration or now-duration in between at %d, got [%s]", i, err)
+			}
+			ands[j].value = at
+			ands[j].relative = true
+		}
+
+		return query{ands: ands}, nextIndex, nil
+	}
+
+	// The number of elements of the array, e.g. tags:count>2 or
+	// tags:count=0
+	if op == "=" && !lexical && isCount(qRune, i) {
+		i += len("count")
+		countOp := string(qRune[i])
+		i++
+		if countOp != "=" && i < len(qRune) && qRune[i] == '=' {
+			countOp += "="
+			i++
+		}
+
+		value, nextIndex, err := lexString(qRune, i)
+		if err == nil {
+			_, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected a number after count%s at %d", countOp, i)
+		}
+
+		if _, ok := wildcardPrefix(path); ok {
+			return query{}, nextIndex, fmt.Errorf("Expected a key without wildcards for count at %d", i)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: value, op: countOp, count: true}}}, nextIndex, nil
+	}
+
+	// Every value is an element of the array, sugar for an equality
+	// per value
+	if op == "=" && isCall(qRune, i, "has") {
+		values, nextIndex, err := lexArguments(qRune, i+len("has"))
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		var comparisons []queryComparison
+		for _, value := range values {
+			comparisons = append(comparisons, queryComparison{key: path, value: value, op: op})
+		}
+		return query{ands: comparisons}, nextIndex, nil
+	}
+
+	if lexical && op == "=" {
+		return query{}, i, fmt.Errorf("Expected range operator after ~ at %d", i)
+	}
+
+	// Points within a radius in kilometers, e.g.
+	// location:near(42.36,-71.06,10)
+	if op == "=" && isCall(qRune, i, "near") {
+		arguments, nextIndex, err := lexArguments(qRune, i+len("near"))
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		if len(arguments) != 3 {
+			return query{}, nextIndex, fmt.Errorf("Expected latitude, longitude and radius arguments to near at %d, got %d", i, len(arguments))
+		}
+
+		var numbers []float64
+		for _, argument := range arguments {
+			f, err := strconv.ParseFloat(argument, 64)
+			if err != nil {
+				return query{}, nextIndex, fmt.Errorf("Expected numeric arguments to near at %d, got: %s", i, argument)
+			}
+			numbers = append(numbers, f)
+		}
+
+		if numbers[2] < 0 {
+			return query{}, nextIndex, fmt.Errorf("Expected a non-negative radius for near at %d", i)
+		}
+
+		near := &geoRadius{numbers[0], numbers[1], numbers[2]}
+		return query{ands: []queryComparison{{key: path, value: strings.Join(arguments, ","), op: op, near: near}}}, nextIndex, nil
+	}
+
+	// Typed literals only match values of that JSON type, e.g.
+	// qty:int(3) matches 3 but not "3"
+	for _, literal := range []string{"int", "float", "bool", "string"} {
+		if lexical || !isCall(qRune, i, literal) {
+			continue
+		}
+
+		arguments, nextIndex, err := lexArguments(qRune, i+len(literal))
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		if len(arguments) != 1 {
+			return query{}, nextIndex, fmt.Errorf("Expected one argument to %s at %d, got %d", literal, i, len(arguments))
+		}
+
+		value, err := canonicalLiteral(literal, arguments[0])
+		if err == nil && op != "=" && (literal == "bool" || literal == "string") {
+			err = fmt.Errorf("Expected = for a %s", literal)
+		}
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected a valid %s literal at %d, got [%s]", literal, i, err)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: value, op: op, literal: literal}}}, nextIndex, nil
+	}
+
+	// Array quantifiers, any is the same as plain equality
+	for _, quantifier := range []string{"any", "all"} {
+		if op != "=" || !isCall(qRune, i, quantifier) {
+			continue
+		}
+
+		arguments, nextIndex, err := lexArguments(qRune, i+len(quantifier))
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		if len(arguments) != 1 {
+			return query{}, nextIndex, fmt.Errorf("Expected one argument to %s at %d, got %d", quantifier, i, len(arguments))
+		}
+
+		all := quantifier == "all"
+		if _, ok := wildcardPrefix(path); ok && all {
+			return query{}, nextIndex, fmt.Errorf("Expected a key without wildcards for all at %d", i)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: arguments[0], op: op, all: all}}}, nextIndex, nil
+	}
+
+	if op == "=" && i < len(qRune) && qRune[i] == '/' {
+		pattern, nextIndex, err := lexRegexp(qRune, i)
+		if err != nil {
+			return query{}, nextIndex, err
+		}
+
+		return query{ands: []queryComparison{{key: path, value: pattern.String(), op: op, pattern: pattern}}}, nextIndex, nil
+	}
+
+	// An @ compares against another field, e.g. a:>@b
+	if i < len(qRune) && qRune[i] == '@' {
+		fieldPath, nextIndex, err := lexKey(qRune, i+1)
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected valid field after @, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+		}
+
+		if _, ok := wildcardPrefix(fieldPath); ok {
+			return query{}, nextIndex, fmt.Errorf("Expected a field without wildcards after @ at %d", i)
+		}
+
+		field := string(qRune[i:nextIndex])
+		return query{ands: []queryComparison{{key: path, value: field, op: op, lexical: lexical, field: fieldPath}}}, nextIndex, nil
+	}
+
+	// An unquoted * matches any value under the key
+	if op == "=" && i < len(qRune) && qRune[i] == '*' && (i+1 == len(qRune) || !isUnquotedRune(qRune[i+1])) {
+		if _, ok := wildcardPrefix(path); ok {
+			return query{}, i, fmt.Errorf("Expected a key without wildcards for * at %d", i)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: "*", op: op, exists: true}}}, i + 1, nil
+	}
+
+	if op == "=" && i < len(qRune) && qRune[i] == '{' {
+		value, nextIndex, err := lexObject(qRune, i)
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected valid JSON object at %d, got [%s]", i, err)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: value, op: op, object: true}}}, nextIndex, nil
+	}
+
+	value, nextIndex, err := lexString(qRune, i)
+	if err != nil {
+		return query{}, nextIndex, fmt.Errorf("Expected valid value, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+	}
+
+	// A pipe separated list matches any of the values, sugar for OR
+	if op == "=" && nextIndex < len(qRune) && qRune[nextIndex] == '|' {
+		alternatives := []query{{ands: []queryComparison{{key: path, value: value, op: op}}}}
+		for nextIndex < len(qRune) && qRune[nextIndex] == '|' {
+			start := nextIndex + 1
+			value, nextIndex, err = lexString(qRune, start)
+			if err == nil && nextIndex == start {
+				err = fmt.Errorf("No string found")
+			}
+			if err != nil {
+				return query{}, nextIndex, fmt.Errorf("Expected valid value after |, got [%s]: `%s`", err, string(qRune[nextIndex:]))
+			}
+
+			alternatives = append(alternatives, query{ands: []queryComparison{{key: path, value: value, op: op}}})
+		}
+
+		return query{ors: [][]query{alternatives}}, nextIndex, nil
+	}
+
+	// now, optionally offset by a duration, is the time the query is
+	// parsed, e.g. expires:<now or _created:>now-1h
+	if op != "=" && !lexical && isNow(value) && qRune[i] != '"' {
+		at, err := resolveNow(value, time.Now())
+		if err != nil {
+			return query{}, nextIndex, fmt.Errorf("Expected now, now+duration or now-duration at %d, got [%s]", i, err)
+		}
+
+		return query{ands: []queryComparison{{key: path, value: at, op: op, relative: true}}}, nextIndex, nil
+	}
+
+	return query{ands: []queryComparison{{key: path, value: value, op: op, lexical: lexical}}}, nextIndex, nil
+}
+
+func isNow(value string) bool {
+	return value == "now" || strings.HasPrefix(value, "now+") || strings.HasPrefix(value, "now-")
+}
+
+// Offsets are Go durations, e.g. now-1h30m, or whole days, e.g.
+// now-7d
+func resolveNow(value string, now time.Time) (string, error) {
+	if value != "now" {
+		offset := strings.TrimPrefix(value, "now")
+		if days, err := strconv.Atoi(strings.TrimSuffix(offset, "d")); err == nil && strings.HasSuffix(offset, "d") {
+			return now.AddDate(0, 0, days).UTC().Format(time.RFC3339Nano), nil
+		}
+
+		duration, err := time.ParseDuration(offset)
+		if err != nil {
+			return "", err
+		}
+		now = now.Add(duration)
+	}
+
+	return now.UTC().Format(time.RFC3339Nano), nil
+}
+
+// Go's regexps run in linear time so the only guard needed is on how
+// big they can get
+const maxRegexpLength = 1000
+
+// Reads a regexp between slashes, \/ is a literal slash
+func lexRegexp(input []rune, index int) (*regexp.Regexp, int, error) {
+	start := index
+	index++
+
+	var s []rune
+	for index < len(input) && input[index] != '/' {
+		if input[index] == '\\' && index+1 < len(input) && input[index+1] == '/' {
+			index++
+		}
+
+		s = append(s, input[index])
+		index++
+	}
+
+	if index >= len(input) {
+		return nil, index, fmt.Errorf("Expected end of regular expression starting at %d", start)
+	}
+
+	if len(s) > maxRegexpLength {
+		return nil, index, fmt.Errorf("Regular expression at %d is longer than %d characters", start, maxRegexpLength)
+	}
+
+	pattern, err := regexp.Compile(string(s))
+	if err != nil {
+		return nil, index, fmt.Errorf("Invalid regular expression at %d: %s", start, err)
+	}
+
+	return pattern, index + 1, nil
+}
+
+// Reads a JSON object starting at index, returning it as canonical
+// JSON
+func lexObject(input []rune, index int) (string, int, error) {
+	rest := string(input[index:])
+	dec := json.NewDecoder(strings.NewReader(rest))
+	var object map[string]any
+	err := dec.Decode(&object)
+	if err != nil {
+		return "", index, err
+	}
+
+	canonical, err := canonicalJSON(object)
+	if err != nil {
+		return "", index, err
+	}
+
+	return canonical, index + utf8.RuneCountInString(rest[:dec.InputOffset()]), nil
+}
+
+// Encodes with object keys sorted and numbers in a single format, so
+// equal values encode identically whether or not they came from a
+// decoder using json.Number
+func canonicalJSON(value any) (string, error) {
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	var decoded any
+	err = json.Unmarshal(bs, &decoded)
+	if err != nil {
+		return "", err
+	}
+
+	bs, err = json.Marshal(decoded)
+	return string(bs), err
+}
+
+// Checks for AND or OR as a standalone word at index
+func isKeyword(qRune []rune, index int, keyword string) bool {
+	end := index + len(keyword)
+	if end > len(qRune) || string(qRune[index:end]) != keyword {
+		return false
+	}
+
+	return end == len(qRune) || unicode.IsSpace(qRune[end]) || qRune[end] == '('
+}
+
+// Parses comparisons, separated by whitespace or AND, and parenthesized
+// groups until the closing parenthesis or the end of input. Any OR
+// splits what has been parsed so far into alternatives.
+func parseExpression(qRune []rune, i int, defaultKey []string) (*query, int, error) {
+	var alternatives []query
+	var current query
+	empty := true
+	for {
+		// Eat whitespace
+		for i < len(qRune) && unicode.IsSpace(qRune[i]) {
+			i++
+		}
+
+		if i >= len(qRune) || qRune[i] == ')' {
+			break
+		}
+
+		if isKeyword(qRune, i, "AND") {
+			if empty {
+				return nil, i, fmt.Errorf("Expected expression before AND at %d", i)
+			}
+			i += len("AND")
+			continue
+		}
+
+		if isKeyword(qRune, i, "OR") {
+			if empty {
+				return nil, i, fmt.Errorf("Expected expression before OR at %d", i)
+			}
+			alternatives = append(alternatives, current)
+			current = query{}
+			empty = true
+			i += len("OR")
+			continue
+		}
+
+		if qRune[i] == '(' {
+			sub, nextIndex, err := parseExpression(qRune, i+1, defaultKey)
+			if err != nil {
+				return nil, nextIndex, err
+			}
+
+			if nextIndex >= len(qRune) || qRune[nextIndex] != ')' {
+				return nil, nextIndex, fmt.Errorf("Expected closing parenthesis at %d", nextIndex)
+			}
+			i = nextIndex + 1
+
+			current.ands = append(current.ands, sub.ands...)
+			current.ors = append(current.ors, sub.ors...)
+			empty = false
+			continue
+		}
+
+		comparison, nextIndex, err := parseComparison(qRune, i, defaultKey)
+		if err != nil {
+			return nil, nextIndex, err
+		}
+		i = nextIndex
+
+		current.ands = append(current.ands, comparison.ands...)
+		current.ors = append(current.ors, comparison.ors...)
+		empty = false
+	}
+
+	if empty {
+		return nil, i, fmt.Errorf("Expected expression at %d", i)
+	}
+
+	if len(alternatives) == 0 {
+		return &current, i, nil
+	}
+
+	alternatives = append(alternatives, current)
+	return &query{ors: [][]query{alternatives}}, i, nil
+}
+
+// A syntax error and the index of the character it was found at
+type queryError struct {
+	position int
+	err      error
+}
+
+func (e queryError) Error() string {
+	return e.err.Error()
+}
+
+func (e queryError) Unwrap() error {
+	return e.err
+}
+
+// E.g. q=a.b:12 AND (c:1 OR d:>2)
+func parseQuery(q string) (*query, error) {
+	return parseQueryWithDefault(q, nil)
+}
+
+// Bare values like foo compare against the default key, e.g. name:foo,
+// when it isn't nil
+func parseQueryWithDefault(q string, defaultKey []string) (*query, error) {
+	if strings.TrimSpace(q) == "" {
+		return &query{}, nil
+	}
+
+	qRune := []rune(q)
+	parsed, i, err := parseExpression(qRune, 0, defaultKey)
+	if err != nil {
+		return nil, queryError{i, err}
+	}
+
+	if i < len(qRune) {
+		return nil, queryError{i, fmt.Errorf("Unexpected closing parenthesis at %d", i)}
+	}
+
+	return parsed, nil
+}
+
+// Calls f with every comparison in the query, including those nested
+// in OR groups
+func (q *query) walk(f func(*queryComparison)) {
+	for i := range q.ands {
+		f(&q.ands[i])
+	}
+
+	for _, alternatives := range q.ors {
+		for i := range alternatives {
+			alternatives[i].walk(f)
+		}
+	}
+}
+
+// How range comparisons treat documents missing the key: exclude never
+// matches them, min treats the value as negative infinity
+var missingPolicies = map[string]bool{"exclude": true, "min": true}
+
+func (q *query) setMissingPolicy(policy string) {
+	q.walk(func(argument *queryComparison) {
+		argument.missingLow = policy == "min" && argument.op != "=" && argument.field == nil && !argument.count && !isIdKey(argument.key)
+	})
+}
+
+// Parses the query and applies the server's query configuration
+func (s server) parseQuery(q string) (*query, error) {
+	var defaultKey []string
+	if s.defaultField != "" {
+		defaultKey = strings.Split(s.defaultField, ".")
+	}
+
+	parsed, err := parseQueryWithDefault(q, defaultKey)
+	if err != nil {
+		return nil, errInvalidQuery(err)
+	}
+
+	// Every OR branch has at least one comparison so this bounds the
+	// branches too
+	terms := 0
+	parsed.walk(func(argument *queryComparison) {
+		terms++
+	})
+	if s.maxQueryTerms > 0 && terms > s.maxQueryTerms {
+		return nil, errInvalidQuery(fmt.Errorf("Query has %d terms, more than the maximum of %d", terms, s.maxQueryTerms))
+	}
+
+	parsed.setMissingPolicy(s.missingRange)
+
+	parsed.walk(func(argument *queryComparison) {
+		if err != nil {
+			return
+		}
+
+		// Rewrite keys that are aliases into the paths they stand for
+		if path, ok := s.aliases[strings.Join(argument.key, ".")]; ok {
+			argument.key = strings.Split(path, ".")
+		}
+		if path, ok := s.aliases[strings.Join(argument.field, ".")]; ok && argument.field != nil {
+			argument.field = strings.Split(path, ".")
+		}
+
+		if s.normalize {
+			argument.normalize = true
+			argument.value = norm.NFC.String(argument.value)
+			for i, part := range argument.key {
+				argument.key[i] = norm.NFC.String(part)
+			}
+			for i, part := range argument.field {
+				argument.field[i] = norm.NFC.String(part)
+			}
+		}
+
+		// Field comparisons are always exact
+		argument.tokenized = argument.field == nil && s.isTokenized(strings.Join(argument.key, "."))
+
+		kind := s.schema[strings.Join(argument.key, ".")]
+		if kind == "" || argument.exists || argument.object || argument.pattern != nil || argument.count || argument.literal != "" || argument.near != nil {
+			return
+		}
+
+		argument.kind = kind
+		if argument.field == nil {
+			value, ok := coerce(kind, argument.value)
+			if !ok {
+				err = errInvalidQuery(fmt.Errorf("Expected a %s for %s, got: `%s`", kind, strings.Join(argument.key, "."), argument.value))
+				return
+			}
+			argument.value = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// The file is a JSON object of alias to dotted path, e.g.
+// {"city": "address.location.city"}
+func loadAliases(file string) (map[string]string, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases map[string]string
+	err = json.Unmarshal(bs, &aliases)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse aliases file %s: %s", file, err)
+	}
+
+	return aliases, nil
+}
+
+// The file is a JSON object of dotted path to type, e.g.
+// {"age": "number", "created": "date"}
+func loadSchema(file string) (map[string]string, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema map[string]string
+	err = json.Unmarshal(bs, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse schema file %s: %s", file, err)
+	}
+
+	for path, kind := range schema {
+		if !schemaTypes[kind] {
+			return nil, fmt.Errorf("Unknown type for %s in schema file %s: %s", path, file, kind)
+		}
+	}
+
+	return schema, nil
+}
+
+func (s server) getDocumentById(id []byte) (map[string]any, error) {
+	valBytes, closer, err := s.db.Get(id)
+	if err == pebble.ErrNotFound {
+		return nil, errNotFound(string(id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var document map[string]any
+	err = s.unmarshal(valBytes, &document)
+	return document, err
+}
+
+// Looks up the id directly rather than going through the index
+func (s server) lookupId(id string) ([]string, error) {
+	_, closer, err := s.db.Get([]byte(id))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not look up id [%#v]: %s", id, err)
+	}
+	closer.Close()
+
+	return []string{id}, nil
+}
+
+func (s server) lookup(pathValue string) ([]string, error) {
+	idsString, closer, err := s.indexDb.Get([]byte(pathValue))
+	if err != nil && err != pebble.ErrNotFound {
+		return nil, fmt.Errorf("Could not look up pathvalue [%#v]: %s", pathValue, err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if len(idsString) == 0 {
+		return nil, nil
+	}
+
+	return decodePostings(idsString), nil
+}
+
+type queryPlanTerm struct {
+	argument   queryComparison
+	usedIndex  bool
+	candidates int
+}
+
+// Describes how a query will be executed: which arguments can be
+// answered by the index and whether the index narrows things down
+// enough to avoid scanning every document.
+type queryPlan struct {
+	terms []queryPlanTerm
+	// Ids that could match the query according to the index
+	ids []string
+	// Whether arguments remain that must be checked with query.match
+	isRange  bool
+	fullScan bool
+	// Match soft deleted documents too, they aren't indexed so this
+	// always scans
+	includeDeleted bool
+	// Stop after this many results, 0 means no limit. Results are
+	// found in id order so this gives the first or last ids matching.
+	limit      int
+	descending bool
+	// Keep matching past the limit so the total counts every match
+	countAll bool
+	// Return results in the order they were inserted rather than by id
+	insertionOrder bool
+}
+
+// Finds documents having every token of the value, or the exact value.
+// Numbers and bools are only indexed exactly, they aren't tokenized.
+func (s server) lookupTokens(argument queryComparison) (map[string]bool, error) {
+	path := strings.Join(argument.key, ".")
+	exact, err := s.lookup(indexKey(path, argument.value))
+	if err != nil {
+		return nil, err
+	}
+
+	var sets []map[string]bool
+	for _, token := range tokenize(argument.value) {
+		ids, err := s.lookup(tokenKey(path, token))
+		if err != nil {
+			return nil, err
+		}
+
+		set := map[string]bool{}
+		for _, id := range ids {
+			set[id] = true
+		}
+		sets = append(sets, set)
+	}
+
+	found := map[string]bool{}
+	if len(sets) > 0 {
+		found = intersect(sets)
+	}
+	for _, id := range exact {
+		found[id] = true
+	}
+	return found, nil
+}
+
+// Unions the postings of every path under the prefix having the value
+func (s server) lookupWildcard(prefix string, value string) (map[string]bool, error) {
+	options := &pebble.IterOptions{}
+	if prefix != "" {
+		options.LowerBound = []byte(escapeIndexKey(prefix) + ".")
+		// '/' sorts right after '.'
+		options.UpperBound = []byte(escapeIndexKey(prefix) + "/")
+	}
+
+	iter := s.indexDb.NewIter(options)
+	defer iter.Close()
+
+	set := map[string]bool{}
+	suffix := "=" + escapeIndexKey(value)
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		// Token and metadata keys start with a null byte
+		if strings.HasPrefix(key, "\x00") || !strings.HasSuffix(key, suffix) || len(iter.Value()) == 0 {
+			continue
+		}
+
+		for _, id := range decodePostings(iter.Value()) {
+			set[id] = true
+		}
+	}
+
+	return set, iter.Error()
+}
+
+// Literal text every match of a regexp anchored at the start of the
+// value begins with, e.g. jo for ^jo.*n$
+func regexpPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+
+	literal := re.Sub[1]
+	if literal.Op != syntax.OpLiteral || literal.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+
+	return string(literal.Rune)
+}
+
+// Finds documents with any value at or under the path
+func (s server) lookupSubtree(path string) (map[string]bool, error) {
+	set := map[string]bool{}
+	// '>' sorts right after '=' and '/' right after '.'
+	for _, bounds := range [][2]string{{"=", ">"}, {".", "/"}} {
+		iter := s.indexDb.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(escapeIndexKey(path) + bounds[0]),
+			UpperBound: []byte(escapeIndexKey(path) + bounds[1]),
+		})
+		for iter.First(); iter.Valid(); iter.Next() {
+			for _, id := range decodePostings(iter.Value()) {
+				set[id] = true
+			}
+		}
+
+		err := iter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+// Finds documents with a value for the path starting with the prefix
+func (s server) lookupPrefix(path string, prefix string) (map[string]bool, error) {
+	lower := []byte(indexKey(path, prefix))
+	upper := append([]byte{}, lower...)
+	// Every key with the prefix sorts before the prefix with its last
+	// byte incremented
+	upper[len(upper)-1]++
+
+	iter := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	defer iter.Close()
+
+	set := map[string]bool{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		for _, id := range decodePostings(iter.Value()) {
+			set[id] = true
+		}
+	}
+
+	return set, iter.Error()
+}
+
+// Whether a range comparison can be narrowed down by the field's
+// buckets
+func (s server) isBucketed(argument queryComparison) bool {
+	if argument.op == "=" || argument.lexical || argument.field != nil || isIdKey(argument.key) {
+		return false
+	}
+
+	path := strings.Join(argument.key, ".")
+	if _, ok := s.buckets[path]; !ok || (argument.kind != "" && argument.kind != "number") || s.schema[path] == "date" {
+		return false
+	}
+
+	_, err := strconv.ParseFloat(argument.value, 64)
+	return err == nil
+}
+
+// Finds documents in the buckets that overlap the range, the range
+// still has to be checked with query.match
+func (s server) lookupBuckets(argument queryComparison) (map[string]bool, error) {
+	path := strings.Join(argument.key, ".")
+	width := s.buckets[path]
+	bound, _ := strconv.ParseFloat(argument.value, 64)
+
+	lower := []byte(bucketKeyPrefix + indexKey(path, ""))
+	upper := append([]byte{}, lower...)
+	upper[len(upper)-1]++
+
+	iter := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	defer iter.Close()
+
+	set := map[string]bool{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		start, err := strconv.ParseFloat(unescapeIndexKey(string(iter.Key()[len(lower):])), 64)
+		if err != nil {
+			continue
+		}
+
+		overlaps := false
+		switch argument.op {
+		case ">", ">=":
+			overlaps = start+width > bound
+		case "<":
+			overlaps = start < bound
+		case "<=":
+			overlaps = start <= bound
+		}
+		if !overlaps {
+			continue
+		}
+
+		for _, id := range decodePostings(iter.Value()) {
+			set[id] = true
+		}
+	}
+
+	return set, iter.Error()
+}
+
+func intersect(sets []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	for id := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if !set[id] {
+				inAll = false
+				break
+			}
+		}
+
+		if inAll {
+			result[id] = true
+		}
+	}
+
+	return result
+}
+
+// Finds the ids that could match the query using the index. Returns
+// false if some matching documents might not be found through the
+// index, in which case every document must be scanned.
+func (s server) candidates(q *query, plan *queryPlan) (map[string]bool, bool, error) {
+	var sets []map[string]bool
+	for _, argument := range q.ands {
+		// Objects and array lengths aren't indexed, the other side of a
+		// field comparison isn't known until the document is read, and
+		// only regexps anchored to a literal prefix can be narrowed
+		// down by the index
+		prefixed := argument.pattern == nil || (regexpPrefix(argument.value) != "" && !isIdKey(argument.key))
+		// Part of the subtree may not be indexed
+		subtree := !argument.exists || (s.indexesEverything() && !isIdKey(argument.key))
+		// Typed fields are indexed in canonical form which wildcard
+		// keys and regexps don't know about
+		_, wildcard := wildcardPrefix(argument.key)
+		typed := (wildcard && len(s.schema) > 0) || (argument.pattern != nil && s.schema[strings.Join(argument.key, ".")] != "")
+		bucketed := s.isBucketed(argument)
+		// Long values aren't indexed, which a regexp could match
+		long := (!argument.tokenized && s.tooLongToIndex(argument.value)) || (argument.pattern != nil && s.maxIndexedLength > 0)
+		// Exact numbers are indexed as written, e.g. 3.0, which a
+		// number literal's canonical form may not be
+		exact := s.useNumber && (argument.literal == "int" || argument.literal == "float")
+		if (argument.op != "=" && !bucketed) || argument.missingLow || argument.near != nil || argument.object || argument.field != nil || argument.count || hasArrayIndex(argument.key) || !s.isIndexedKey(argument.key) || !prefixed || !subtree || typed || long || exact {
+			plan.isRange = true
+			plan.terms = append(plan.terms, queryPlanTerm{argument: argument})
+			continue
+		}
+
+		atomic.AddInt64(&s.metrics.indexLookups, 1)
+
+		// The index finds documents where any element matches, can't
+		// tell a key with a dot in it from nested keys and doesn't
+		// record the types of values
+		if argument.all || hasDottedSegment(argument.key) || argument.literal != "" {
+			plan.isRange = true
+		}
+
+		var set map[string]bool
+		var err error
+		if bucketed {
+			plan.isRange = true
+			set, err = s.lookupBuckets(argument)
+		} else if argument.exists {
+			set, err = s.lookupSubtree(strings.Join(argument.key, "."))
+		} else if argument.pattern != nil {
+			plan.isRange = true
+			set, err = s.lookupPrefix(strings.Join(argument.key, "."), regexpPrefix(argument.value))
+		} else if prefix, ok := wildcardPrefix(argument.key); ok {
+			// Keys are matched loosely so query.match double checks
+			plan.isRange = true
+			set, err = s.lookupWildcard(prefix, argument.value)
+		} else if argument.tokenized {
+			set, err = s.lookupTokens(argument)
+		} else {
+			var ids []string
+			if isIdKey(argument.key) {
+				ids, err = s.lookupId(argument.value)
+			} else {
+				ids, err = s.lookup(indexKey(strings.Join(argument.key, "."), argument.value))
+			}
+
+			set = map[string]bool{}
 			for _, id := range ids {
-				_, ok := idsArgumentCount[id]
-				if !ok {
-					idsArgumentCount[id] = 0
+				set[id] = true
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		sets = append(sets, set)
+
+		plan.terms = append(plan.terms, queryPlanTerm{argument: argument, usedIndex: true, candidates: len(set)})
+	}
+
+	for _, alternatives := range q.ors {
+		// Alternatives narrow each other down, so query.match must
+		// check every candidate
+		plan.isRange = true
+
+		union := map[string]bool{}
+		indexed := true
+		for _, alternative := range alternatives {
+			ids, ok, err := s.candidates(&alternative, plan)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if !ok {
+				indexed = false
+				continue
+			}
+
+			for id := range ids {
+				union[id] = true
+			}
+		}
+
+		if indexed {
+			sets = append(sets, union)
+		}
+	}
+
+	if len(sets) == 0 {
+		return nil, false, nil
+	}
+
+	return intersect(sets), true, nil
+}
+
+// The index key when the query is a single plain equality, so every
+// id in its postings matches
+func (s server) equalityKey(q *query) (string, bool) {
+	if len(q.ands) != 1 || len(q.ors) != 0 {
+		return "", false
+	}
+
+	argument := q.ands[0]
+	if _, ok := wildcardPrefix(argument.key); ok || argument.op != "=" || isIdKey(argument.key) || !s.isIndexedKey(argument.key) {
+		return "", false
+	}
+	if argument.tokenized || argument.object || argument.pattern != nil || argument.exists || argument.all || argument.field != nil || argument.count || argument.literal != "" || argument.near != nil || hasArrayIndex(argument.key) || hasDottedSegment(argument.key) || s.tooLongToIndex(argument.value) {
+		return "", false
+	}
+
+	return indexKey(strings.Join(argument.key, "."), argument.value), true
+}
+
+func (s server) planQuery(q *query, skipIndex bool) (*queryPlan, error) {
+	var plan queryPlan
+
+	// Postings are kept sorted so a single equality can page through
+	// them as is, without building and sorting a set of every id
+	if key, ok := s.equalityKey(q); ok && !skipIndex && atomic.LoadInt64(s.unindexed) == 0 {
+		atomic.AddInt64(&s.metrics.indexLookups, 1)
+		ids, err := s.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.ids = ids
+		plan.terms = []queryPlanTerm{{argument: q.ands[0], usedIndex: true, candidates: len(ids)}}
+		return &plan, nil
+	}
+	ids, indexed, err := s.candidates(q, &plan)
+	if err != nil {
+		return nil, err
+	}
+
+	if skipIndex || !indexed || atomic.LoadInt64(s.unindexed) > 0 {
+		plan.fullScan = true
+		return &plan, nil
+	}
+
+	for id := range ids {
+		plan.ids = append(plan.ids, id)
+	}
+	sort.Strings(plan.ids)
+
+	return &plan, nil
+}
+
+func (s server) countDocuments() int {
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		count++
+	}
+
+	return count
+}
+
+func (s server) explain(plan *queryPlan) map[string]any {
+	var terms []map[string]any
+	for _, term := range plan.terms {
+		t := map[string]any{
+			"key":       strings.Join(term.argument.key, "."),
+			"op":        term.argument.op,
+			"value":     term.argument.value,
+			"usedIndex": term.usedIndex,
+		}
+		if term.usedIndex {
+			t["candidates"] = term.candidates
+		}
+		terms = append(terms, t)
+	}
+
+	estimatedDocuments := len(plan.ids)
+	if plan.fullScan {
+		estimatedDocuments = s.countDocuments()
+	}
+
+	return map[string]any{
+		"terms":              terms,
+		"fullScan":           plan.fullScan,
+		"estimatedDocuments": estimatedDocuments,
+	}
+}
+
+type result struct {
+	id       string
+	document map[string]any
+	// How many comparisons matched, only set when sorting by
+	// relevance
+	score int
+	// How each term of the plan was satisfied, only set with debug=true
+	provenance []map[string]any
+}
+
+// Which terms the document matches and whether the index found it by
+// them or query.match checked them after reading it
+func (plan *queryPlan) provenance(id string, document map[string]any) []map[string]any {
+	provenance := []map[string]any{}
+	for _, term := range plan.terms {
+		via := "match"
+		if term.usedIndex && !plan.fullScan {
+			via = "index"
+		}
+
+		provenance = append(provenance, map[string]any{
+			"key":     strings.Join(term.argument.key, "."),
+			"op":      term.argument.op,
+			"value":   term.argument.value,
+			"matched": term.argument.match(id, document),
+			"via":     via,
+		})
+	}
+
+	return provenance
+}
+
+// How much work a search did
+type searchStats struct {
+	// Documents read
+	scanned int
+	// Documents matched, including any past the limit when counting
+	// them all
+	total int
+}
+
+// Runs the query using the candidate ids from the plan or by scanning
+// every document if the plan requires it. Also returns how many
+// documents were read.
+func (s server) search(q *query, plan *queryPlan) ([]result, searchStats, error) {
+	var results []result
+	var stats searchStats
+	done := func() bool {
+		return plan.limit > 0 && len(results) >= plan.limit && !plan.countAll
+	}
+	add := func(id string, document map[string]any) bool {
+		stats.total++
+		if plan.limit > 0 && len(results) >= plan.limit {
+			return true
+		}
+
+		results = append(results, result{id: id, document: document})
+		return !s.tooManyResults(results)
+	}
+
+	if plan.insertionOrder {
+		candidates := map[string]bool{}
+		for _, id := range plan.ids {
+			candidates[id] = true
+		}
+
+		err := s.eachInsertion(func(id string) (bool, error) {
+			if !plan.fullScan && !candidates[id] {
+				return true, nil
+			}
+
+			// Deleted documents stay in the log
+			document, err := s.getDocumentById([]byte(id))
+			if isNotFound(err) {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			stats.scanned++
+
+			if isDeleted(document) && !plan.includeDeleted {
+				return true, nil
+			}
+
+			if (!plan.fullScan && !plan.isRange) || q.match(id, document) {
+				if !add(id, document) {
+					return false, s.errTooManyResults()
+				}
+			}
+			return !done(), nil
+		})
+		if err != nil {
+			return nil, stats, err
+		}
+
+		return results, stats, nil
+	}
+
+	if !plan.fullScan {
+		for i := range plan.ids {
+			if done() {
+				break
+			}
+
+			id := plan.ids[i]
+			if plan.descending {
+				id = plan.ids[len(plan.ids)-1-i]
+			}
+
+			// The index can be briefly ahead of or behind the
+			// documents, e.g. while a batched unindex is queued
+			document, err := s.getDocumentById([]byte(id))
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, stats, err
+			}
+			stats.scanned++
+
+			if isDeleted(document) && !plan.includeDeleted {
+				continue
+			}
+
+			if (!plan.isRange || q.match(id, document)) && !add(id, document) {
+				return nil, stats, s.errTooManyResults()
+			}
+		}
+
+		return results, stats, nil
+	}
+
+	// Documents are keyed by id so scans are in id order too
+	first, next := (*pebble.Iterator).First, (*pebble.Iterator).Next
+	if plan.descending {
+		first, next = (*pebble.Iterator).Last, (*pebble.Iterator).Prev
+	}
+
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	for first(iter); iter.Valid() && !done(); next(iter) {
+		// A single corrupt or hand edited document shouldn't fail
+		// every scan
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err == nil && document == nil {
+			err = fmt.Errorf("Not a JSON object")
+		}
+		if err != nil {
+			log.Printf("Skipping unreadable document [%#v]: %s", string(iter.Key()), err)
+			continue
+		}
+		stats.scanned++
+
+		if isDeleted(document) && !plan.includeDeleted {
+			continue
+		}
+
+		if q.match(string(iter.Key()), document) && !add(string(iter.Key()), document) {
+			return nil, stats, s.errTooManyResults()
+		}
+	}
+
+	return results, stats, nil
+}
+
+func (s server) tooManyResults(results []result) bool {
+	return s.maxResults > 0 && len(results) > s.maxResults
+}
+
+// Fails plans reading every document when scans are disabled
+func (s server) checkScan(plan *queryPlan) error {
+	if s.noScan && plan.fullScan {
+		return apiError{http.StatusBadRequest, "scan_disabled", fmt.Errorf("Query can't be answered from the index and full scans are disabled")}
+	}
+
+	return nil
+}
+
+func (s server) errTooManyResults() error {
+	return apiError{http.StatusBadRequest, "too_many_results", fmt.Errorf("Query matched more than the maximum of %d documents", s.maxResults)}
+}
+
+type sortKey struct {
+	key        []string
+	descending bool
+	relevance  bool
+}
+
+// E.g. sort=lastName,-age. sort=relevance puts documents matching the
+// most comparisons first.
+func parseSort(sort string) []sortKey {
+	var keys []sortKey
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if field == "relevance" {
+			keys = append(keys, sortKey{relevance: true, descending: !descending})
+			continue
+		}
+
+		keys = append(keys, sortKey{
+			key:        strings.Split(field, "."),
+			descending: descending,
+		})
+	}
+
+	return keys
+}
+
+// Orders numbers before strings before booleans before anything else
+func typeRank(value any) int {
+	if _, ok := value.(string); ok {
+		return 1
+	}
+	if _, ok := value.(bool); ok {
+		return 2
+	}
+	if _, ok := toFloat(value); ok {
+		return 0
+	}
+
+	return 3
+}
+
+func compareValues(a, b any) int {
+	aRank, bRank := typeRank(a), typeRank(b)
+	if aRank != bRank {
+		return aRank - bRank
+	}
+
+	switch aRank {
+	case 0:
+		left, _ := toFloat(a)
+		right, _ := toFloat(b)
+		if left < right {
+			return -1
+		} else if left > right {
+			return 1
+		}
+		return 0
+	case 1:
+		return strings.Compare(a.(string), b.(string))
+	case 2:
+		if a.(bool) == b.(bool) {
+			return 0
+		} else if !a.(bool) {
+			return -1
+		}
+		return 1
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// Documents missing a key sort after the ones that have it regardless
+// of direction. Ties are broken by id so the order is deterministic.
+func sortResults(results []result, keys []sortKey) {
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, key := range keys {
+			if key.relevance {
+				if results[i].score == results[j].score {
+					continue
+				}
+
+				if key.descending {
+					return results[i].score > results[j].score
+				}
+				return results[i].score < results[j].score
+			}
+
+			left, leftOk := getPath(results[i].document, key.key)
+			right, rightOk := getPath(results[j].document, key.key)
+			if !leftOk || !rightOk {
+				if leftOk != rightOk {
+					return leftOk
+				}
+				continue
+			}
+
+			cmp := compareValues(left, right)
+			if cmp == 0 {
+				continue
+			}
+
+			if key.descending {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+
+		return results[i].id < results[j].id
+	})
+}
+
+func (s server) searchDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	start := time.Now()
+	defer func() {
+		s.metrics.observeSearch(time.Since(start))
+	}()
+
+	// HEAD and CSV responses aren't cached, and nothing is unless the
+	// cache is enabled
+	cacheKey := resultCacheKey(r.URL.Query())
+	cached, generation, ok := s.cache.get(cacheKey)
+	if ok && r.Method == http.MethodGet {
+		atomic.AddInt64(&s.metrics.cacheHits, 1)
+		jsonResponse(w, r, cached, nil)
+		return
+	}
+
+	q, err := s.parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	if missing := r.URL.Query().Get("missing"); missing != "" {
+		if !missingPolicies[missing] {
+			jsonResponse(w, r, nil, fmt.Errorf("Expected missing to be exclude or min"))
+			return
+		}
+		q.setMissingPolicy(missing)
+	}
+
+	// Results relative to now change without any writes
+	cache := s.cache
+	q.walk(func(argument *queryComparison) {
+		if argument.relative {
+			cache = nil
+		}
+	})
+
+	// Searches don't wait for queued index updates unless asked
+	if s.indexWriter != nil && r.URL.Query().Get("wait") == "true" {
+		s.indexWriter.flush()
+	}
+
+	includeDeleted := r.URL.Query().Get("includeDeleted") == "true"
+	plan, err := s.planQuery(q, includeDeleted || r.URL.Query().Get("skipIndex") == "true")
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+	plan.includeDeleted = includeDeleted
+
+	if r.URL.Query().Get("explain") == "true" {
+		jsonResponse(w, r, map[string]any{"explain": s.explain(plan)}, nil)
+		return
+	}
+
+	err = s.checkScan(plan)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			jsonResponse(w, r, nil, fmt.Errorf("Expected limit to be a non-negative integer, got: %s", l))
+			return
+		}
+	}
+
+	switch r.URL.Query().Get("shape") {
+	case "", "array", "map":
+	default:
+		jsonResponse(w, r, nil, fmt.Errorf("Expected shape to be array or map"))
+		return
+	}
+
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		plan.descending = true
+	case "insertion":
+		plan.insertionOrder = true
+	default:
+		jsonResponse(w, r, nil, fmt.Errorf("Expected order to be asc, desc or insertion"))
+		return
+	}
+
+	// Without a sort results come out in id order and searching can
+	// stop once it has enough
+	sortKeys := parseSort(r.URL.Query().Get("sort"))
+	if len(sortKeys) == 0 {
+		plan.limit = limit
+	}
+
+	// Every candidate of an index-only plan matches so the total is
+	// already known. Otherwise an exact total means reading every
+	// candidate, exactTotal=false estimates it from those read.
+	indexOnly := !plan.fullScan && !plan.isRange
+	exactTotal := r.URL.Query().Get("exactTotal") != "false"
+	plan.countAll = exactTotal && !indexOnly
+
+	results, stats, err := s.search(q, plan)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	if elapsed := time.Since(start); s.slowQuery > 0 && elapsed > s.slowQuery {
+		log.Printf("WARN Slow query took %s: q=%q usedIndex=%t scanned=%d", elapsed, r.URL.Query().Get("q"), !plan.fullScan, stats.scanned)
+	}
+
+	total, totalExact := stats.total, true
+	if indexOnly {
+		total = len(plan.ids)
+	} else if !exactTotal && stats.scanned > 0 {
+		candidates := len(plan.ids)
+		if plan.fullScan {
+			candidates = int(atomic.LoadInt64(&s.metrics.documents))
+		}
+
+		// Assume the rest match at the same rate as those read
+		if stats.scanned < candidates {
+			total, totalExact = stats.total*candidates/stats.scanned, false
+		}
+	}
+
+	if len(sortKeys) > 0 {
+		for _, key := range sortKeys {
+			if key.relevance {
+				for i := range results {
+					results[i].score = q.score(results[i].id, results[i].document)
+				}
+				break
+			}
+		}
+
+		sortResults(results, sortKeys)
+		if limit > 0 && len(results) > limit {
+			results = results[:limit]
+		}
+	}
+
+	debug := r.URL.Query().Get("debug") == "true"
+	flatten := r.URL.Query().Get("flatten") == "true"
+	for i := range results {
+		// Before redaction so terms on redacted fields still match
+		if debug {
+			results[i].provenance = plan.provenance(results[i].id, results[i].document)
+		}
+		results[i].document = s.redact(results[i].document)
+		if flatten {
+			results[i].document = flattenValues(results[i].document, "", map[string]any{})
+		}
+	}
+
+	// HEAD only reports how many matched
+	if r.Method == http.MethodHead {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		err = csvResponse(w, results)
+		if err != nil {
+			log.Printf("Could not write CSV response: %s", err)
+		}
+		return
+	}
+
+	if r.URL.Query().Get("shape") == "map" {
+		byId := map[string]any{}
+		for _, result := range results {
+			byId[result.id] = result.document
+		}
+
+		body := map[string]any{"documents": byId, "count": len(results), "scanned": stats.scanned, "total": total, "totalExact": totalExact}
+		cache.put(cacheKey, generation, body)
+		jsonResponse(w, r, body, nil)
+		return
+	}
+
+	// Not nil so no matches is [] rather than null
+	documents := []any{}
+	for _, result := range results {
+		document := map[string]any{
+			"id":   result.id,
+			"body": result.document,
+		}
+		if debug {
+			document["debug"] = result.provenance
+		}
+		documents = append(documents, document)
+	}
+
+	body := map[string]any{"documents": documents, "count": len(documents), "scanned": stats.scanned, "total": total, "totalExact": totalExact}
+	cache.put(cacheKey, generation, body)
+	jsonResponse(w, r, body, nil)
+}
+
+// Reports whether {"q": "..."} parses without running it. Invalid
+// queries aren't an error response, they're described in the body.
+func (s server) validateQuery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Q string `json:"q"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected a JSON object with a q string: %s", err))
+		return
+	}
+
+	_, err = s.parseQuery(body.Q)
+	if err == nil {
+		jsonResponse(w, r, map[string]any{"valid": true}, nil)
+		return
+	}
+
+	res := map[string]any{"valid": false, "error": err.Error()}
+	var qe queryError
+	if errors.As(err, &qe) {
+		res["position"] = qe.position
+	}
+	jsonResponse(w, r, res, nil)
+}
+
+// Responds with the document exactly as stored rather than re-encoding
+// it
+func (s server) getRawDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	valBytes, closer, err := s.db.Get([]byte(id))
+	if err == pebble.ErrNotFound {
+		jsonResponse(w, r, nil, errNotFound(id))
+		return
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+	defer closer.Close()
+
+	var document map[string]any
+	if s.unmarshal(valBytes, &document) == nil && isDeleted(document) && r.URL.Query().Get("includeDeleted") != "true" {
+		jsonResponse(w, r, nil, errNotFound(id))
+		return
+	}
+
+	// Redacting means re-encoding
+	if len(s.redactions) > 0 {
+		valBytes, err = json.Marshal(s.redact(document))
+		if err != nil {
+			jsonResponse(w, r, nil, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(valBytes)
+}
+
+// Lists the index keys of the document under the indexing rules in
+// effect, to debug why it is or isn't found
+func (s server) getPathValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	document, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(document) {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	// Keys hold the values, so ones for redacted fields are left out
+	keys := []string{}
+	for _, key := range s.indexKeys(document) {
+		unprefixed := strings.TrimPrefix(strings.TrimPrefix(key, tokenKeyPrefix), bucketKeyPrefix)
+		if !coveredBy(indexKeyPath(unprefixed), s.redactions) {
+			keys = append(keys, key)
+		}
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"pathValues": keys,
+	}, nil)
+}
+
+// Flattens a document into cells keyed by dotted path. Unlike
+// getPathValuePairs arrays are kept, JSON-encoded into a single cell.
+func flattenDocument(obj map[string]any, prefix string, cells map[string]string) {
+	for key, val := range obj {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch t := val.(type) {
+		case map[string]any:
+			flattenDocument(t, key, cells)
+		case []any:
+			bs, _ := json.Marshal(t)
+			cells[key] = string(bs)
+		case nil:
+			cells[key] = ""
+		default:
+			cells[key] = fmt.Sprintf("%v", t)
+		}
+	}
+}
+
+// Like flattenDocument but keeps values as they are, for flatten=true.
+// Arrays and empty objects are kept whole.
+func flattenValues(obj map[string]any, prefix string, flat map[string]any) map[string]any {
+	for key, val := range obj {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if child, ok := val.(map[string]any); ok && len(child) > 0 {
+			flattenValues(child, key, flat)
+			continue
+		}
+
+		flat[key] = val
+	}
+
+	return flat
+}
+
+// Writes results with a header row of the id followed by the sorted
+// union of every document's paths.
+func csvResponse(w http.ResponseWriter, results []result) error {
+	var rows []map[string]string
+	columns := map[string]bool{}
+	for _, result := range results {
+		cells := map[string]string{}
+		flattenDocument(result.document, "", cells)
+		for column := range cells {
+			columns[column] = true
+		}
+		rows = append(rows, cells)
+	}
+
+	header := []string{"id"}
+	for column := range columns {
+		header = append(header, column)
+	}
+	sort.Strings(header[1:])
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for i, cells := range rows {
+		record := []string{results[i].id}
+		for _, column := range header[1:] {
+			record = append(record, cells[column])
+		}
+
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s server) getDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	document, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(document) && r.URL.Query().Get("includeDeleted") != "true" {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	document = s.redact(document)
+	if r.URL.Query().Get("flatten") == "true" {
+		document = flattenValues(document, "", map[string]any{})
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"document": document,
+	}, nil)
+}
+
+// Returns the document without the redacted paths. Objects along the
+// paths are copied so the document passed in isn't changed.
+func (s server) redact(document map[string]any) map[string]any {
+	for path := range s.redactions {
+		document = redactPath(document, strings.Split(path, "."), s.redactMask)
+	}
+
+	return document
+}
+
+func redactPath(obj map[string]any, path []string, mask string) map[string]any {
+	value, ok := obj[path[0]]
+	if !ok {
+		return obj
+	}
+
+	copied := make(map[string]any, len(obj))
+	for key, val := range obj {
+		copied[key] = val
+	}
+
+	if len(path) > 1 {
+		child, ok := value.(map[string]any)
+		if !ok {
+			return obj
+		}
+
+		copied[path[0]] = redactPath(child, path[1:], mask)
+		return copied
+	}
+
+	if mask == "" {
+		delete(copied, path[0])
+	} else {
+		copied[path[0]] = mask
+	}
+	return copied
+}
+
+// Objects in the patch are merged into the document recursively, any
+// other value replaces what was in the document.
+func mergeDocuments(document map[string]any, patch map[string]any) map[string]any {
+	merged := map[string]any{}
+	for key, val := range document {
+		merged[key] = val
+	}
+
+	for key, val := range patch {
+		patchObject, ok := val.(map[string]any)
+		if ok {
+			if documentObject, ok := merged[key].(map[string]any); ok {
+				merged[key] = mergeDocuments(documentObject, patchObject)
+				continue
+			}
+		}
+
+		merged[key] = val
+	}
+
+	return merged
+}
+
+// Implements JSON Merge Patch (RFC 7386): nulls delete keys, objects
+// merge recursively and everything else, including arrays, replaces
+// the target.
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	merged := map[string]any{}
+	if ok {
+		for key, val := range targetObject {
+			merged[key] = val
+		}
+	}
+
+	for key, val := range patchObject {
+		if val == nil {
+			delete(merged, key)
+			continue
+		}
+
+		merged[key] = mergePatch(merged[key], val)
+	}
+
+	return merged
+}
+
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/merge-patch+json"
+}
+
+// Uses RFC 7386 semantics for application/merge-patch+json requests
+// and mergeDocuments otherwise
+func applyPatch(r *http.Request, document map[string]any, patch map[string]any) map[string]any {
+	if isMergePatch(r) {
+		return mergePatch(document, patch).(map[string]any)
+	}
+
+	return mergeDocuments(document, patch)
+}
+
+func (s server) updateDocument(id string, old map[string]any, document map[string]any) error {
+	// The creation time can't be changed by an update
+	if created, ok := old[createdKey]; ok {
+		document[createdKey] = created
+	} else {
+		delete(document, createdKey)
+	}
+	document[updatedKey] = timestamp()
+
+	bs, err := s.encodeDocument(document)
+	if err != nil {
+		return err
+	}
+
+	// Only postings of path-values that were dropped or added change
+	removed, added := diffKeys(s.indexKeys(old), s.indexKeys(document))
+	s.updateIndex(indexOp{id: id, remove: removed, add: added})
+
+	return s.setDocument(id, bs)
+}
+
+// The keys only in old and the keys only in new
+func diffKeys(old []string, new []string) ([]string, []string) {
+	inOld := map[string]bool{}
+	for _, key := range old {
+		inOld[key] = true
+	}
+
+	inNew := map[string]bool{}
+	var added []string
+	for _, key := range new {
+		inNew[key] = true
+		if !inOld[key] {
+			added = append(added, key)
+		}
+	}
+
+	var removed []string
+	for _, key := range old {
+		if !inNew[key] {
+			removed = append(removed, key)
+		}
+	}
+
+	return removed, added
+}
+
+// Returns a copy of obj with the value appended to the array at the
+// path, creating the array and any objects above it that are missing.
+// Returns false if something other than an object or array is in the
+// way.
+func appendPath(obj map[string]any, path []string, value any) (map[string]any, bool) {
+	copied := make(map[string]any, len(obj)+1)
+	for key, val := range obj {
+		copied[key] = val
+	}
+
+	existing, ok := obj[path[0]]
+	if len(path) > 1 {
+		child := map[string]any{}
+		if ok {
+			if child, ok = existing.(map[string]any); !ok {
+				return nil, false
+			}
+		}
+
+		appended, ok := appendPath(child, path[1:], value)
+		if !ok {
+			return nil, false
+		}
+		copied[path[0]] = appended
+		return copied, true
+	}
+
+	if !ok {
+		copied[path[0]] = []any{value}
+		return copied, true
+	}
+
+	elements, ok := existing.([]any)
+	if !ok {
+		return nil, false
+	}
+
+	// The old document's array must stay as it was to unindex it
+	copied[path[0]] = append(append([]any{}, elements...), value)
+	return copied, true
+}
+
+// Appends a value to an array in the document, e.g. {"path": "tags",
+// "value": "go"}
+func (s server) appendDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	body, err := s.decodeDocument(r.Body, false)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	path, _ := body["path"].(string)
+	if path == "" {
+		err = fmt.Errorf("Expected a path to append to")
+	} else if key := strings.Split(path, ".")[0]; key == createdKey || key == updatedKey || key == deletedKey || key == "_id" {
+		err = fmt.Errorf("Can't append to reserved key: %s", key)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	document, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(document) {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	appended, ok := appendPath(document, strings.Split(path, "."), body["value"])
+	if !ok {
+		err = fmt.Errorf("Expected %s to be an array or missing", path)
+	} else if s.maxDepth > 0 && depth(appended) > s.maxDepth {
+		// The value and objects created for the path add to the depth
+		err = apiError{http.StatusBadRequest, "invalid_document", fmt.Errorf("Document is nested more than %d levels deep", s.maxDepth)}
+	} else {
+		err = s.updateDocument(id, document, appended)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"document": s.redact(appended),
+	}, nil)
+}
+
+// Replaces the document with the request body
+func (s server) putDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	document, err := s.decodeDocument(r.Body, s.wrapNonObjects)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	old, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(old) {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	err = s.updateDocument(id, old, document)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"document": s.redact(document),
+	}, nil)
+}
+
+func (s server) patchDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	patch, err := s.decodeDocument(r.Body, false)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	document, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(document) {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	merged := applyPatch(r, document, patch)
+	err = s.updateDocument(id, document, merged)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"document": s.redact(merged),
+	}, nil)
+}
+
+func (s server) patchDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	patch, err := s.decodeDocument(r.Body, false)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	q, err := s.parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	if q.isEmpty() && r.URL.Query().Get("all") != "true" {
+		jsonResponse(w, r, nil, fmt.Errorf("Refusing to update every document without all=true"))
+		return
+	}
+
+	plan, err := s.planQuery(q, false)
+	if err == nil {
+		err = s.checkScan(plan)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	results, _, err := s.search(q, plan)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	for _, result := range results {
+		err = s.updateDocument(result.id, result.document, applyPatch(r, result.document, patch))
+		if err != nil {
+			jsonResponse(w, r, nil, err)
+			return
+		}
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"updated": len(results),
+	}, nil)
+}
+
+func (s server) deleteDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	err := s.delete(id)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"id": id,
+	}, nil)
+}
+
+// Unindexes the document and removes it, or marks it deleted with
+// softDelete
+func (s server) delete(id string) error {
+	document, err := s.getDocumentById([]byte(id))
+	if err == nil && isDeleted(document) {
+		err = errNotFound(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.unindex(id, document)
+
+	if s.softDelete {
+		tombstone := map[string]any{}
+		for key, val := range document {
+			tombstone[key] = val
+		}
+		tombstone[deletedKey] = true
+		tombstone[updatedKey] = timestamp()
+
+		var bs []byte
+		bs, err = json.Marshal(tombstone)
+		if err == nil {
+			err = s.setDocument(id, bs)
+		}
+	} else {
+		err = s.removeDocument(id)
+		if err == nil {
+			atomic.AddInt64(&s.metrics.documents, -1)
+		}
+	}
+	return err
+}
+
+// Deletes each of {"ids": [...]}, reporting per id whether it was
+// deleted rather than stopping at the first failure
+func (s server) batchDeleteDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Ids []string `json:"ids"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected a JSON object with an ids array: %s", err))
+		return
+	}
+
+	deleted := 0
+	results := []map[string]any{}
+	for _, id := range body.Ids {
+		result := map[string]any{"id": id, "deleted": true}
+		if err := s.delete(id); err != nil {
+			result["deleted"] = false
+			result["error"] = err.Error()
+		} else {
+			deleted++
+		}
+		results = append(results, result)
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"deleted": deleted,
+		"results": results,
+	}, nil)
+}
+
+// Permanently removes soft deleted documents
+func (s server) purge() (int, error) {
+	batch := s.db.NewBatch()
+	defer batch.Close()
+
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+
+	var entries []walEntry
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil || !isDeleted(document) {
+			continue
+		}
+
+		err = batch.Delete(iter.Key(), nil)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, walEntry{Op: walDelete, Id: string(iter.Key())})
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	err := s.logged(entries, func() error {
+		return batch.Commit(pebble.Sync)
+	})
+	s.cache.invalidate()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := len(entries)
+
+	atomic.AddInt64(&s.metrics.documents, -int64(purged))
+	return purged, nil
+}
+
+func (s server) purgeDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	purged, err := s.purge()
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"purged": purged,
+	}, nil)
+}
+
+// How many documents reindexing logs progress after
+const reindexProgressEvery = 100000
+
+func (s server) reindex() {
+	start := time.Now()
+	unindexed := atomic.LoadInt64(s.unindexed)
+
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		count++
+		if count%reindexProgressEvery == 0 {
+			log.Printf("Reindexed %d documents", count)
+		}
+
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil {
+			log.Printf("Unable to parse bad document, %s: %s", string(iter.Key()), err)
+		}
+		if isDeleted(document) {
+			continue
+		}
+		s.index(string(iter.Key()), document)
+	}
+
+	if s.indexWriter != nil {
+		s.indexWriter.flush()
+	}
+
+	// Documents inserted without indexing while this ran may have been
+	// missed, in which case searches keep scanning
+	atomic.CompareAndSwapInt64(s.unindexed, unindexed, 0)
+
+	if count >= reindexProgressEvery {
+		log.Printf("Reindexed %d documents in %s", count, time.Since(start))
+	}
+}
+
+func (s server) reindexDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.reindex()
+	jsonResponse(w, r, map[string]any{}, nil)
+}
+
+// Calls f with each value indexed for the field and the ids indexed
+// under it
+func (s server) eachValue(field string, f func(value string, ids []string)) error {
+	prefix := escapeIndexKey(field) + "="
+	iter := s.indexDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		// '>' sorts right after '='
+		UpperBound: []byte(escapeIndexKey(field) + ">"),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if len(iter.Value()) == 0 {
+			continue
+		}
+
+		f(unescapeIndexKey(strings.TrimPrefix(string(iter.Key()), prefix)), decodePostings(iter.Value()))
+	}
+
+	return iter.Error()
+}
+
+// Whether every value of the field can be read from the index.
+// Strings too long to index and documents waiting on a reindex are
+// only found by reading every document, like queries do.
+func (s server) valuesIndexed(field string) bool {
+	return s.isIndexed(field) && s.maxIndexedLength == 0 && atomic.LoadInt64(s.unindexed) == 0
+}
+
+// Values of the field as they were indexed, in sorted order. Fields
+// whose values aren't all indexed are read from every document.
+func (s server) distinct(field string) ([]string, error) {
+	var values []string
+	if !s.valuesIndexed(field) {
+		found, err := s.scanValues(field)
+		for value := range found {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		return values, err
+	}
+
+	err := s.eachValue(field, func(value string, ids []string) {
+		values = append(values, value)
+	})
+	return values, err
+}
+
+// Counts the documents among results having each value of the field
+func (s server) facets(field string, results []result) (map[string]int, error) {
+	counts := map[string]int{}
+	if !s.valuesIndexed(field) {
+		for _, result := range results {
+			value, ok := getPath(result.document, strings.Split(field, "."))
+			if !ok {
+				continue
+			}
+
+			elements, ok := value.([]any)
+			if !ok {
+				elements = []any{value}
+			}
+
+			seen := map[string]bool{}
+			for _, element := range elements {
+				switch element.(type) {
+				case map[string]any, []any:
+					continue
+				}
+
+				str := fmt.Sprintf("%v", element)
+				if !seen[str] {
+					seen[str] = true
+					counts[str]++
 				}
+			}
+		}
+
+		return counts, nil
+	}
+
+	matching := map[string]bool{}
+	for _, result := range results {
+		matching[result.id] = true
+	}
+
+	err := s.eachValue(field, func(value string, ids []string) {
+		for _, id := range ids {
+			if matching[id] {
+				counts[value]++
+			}
+		}
+	})
+	return counts, err
+}
+
+func (s server) facetValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected field parameter"))
+		return
+	}
+
+	if path, ok := s.aliases[field]; ok {
+		field = path
+	}
+
+	// Values of redacted fields are never returned
+	if coveredBy(field, s.redactions) {
+		jsonResponse(w, r, nil, fmt.Errorf("Field is redacted: %s", field))
+		return
+	}
+
+	q, err := s.parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	plan, err := s.planQuery(q, false)
+	if err == nil {
+		err = s.checkScan(plan)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	results, _, err := s.search(q, plan)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	counts, err := s.facets(field, results)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"facets": counts,
+	}, nil)
+}
+
+// Picks up to n documents uniformly at random in one pass, keeping
+// only n in memory
+func (s server) sample(n int, includeDeleted bool) ([]result, error) {
+	random := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	var reservoir []result
+	seen := 0
+
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil || document == nil || (isDeleted(document) && !includeDeleted) {
+			continue
+		}
+
+		seen++
+		if len(reservoir) < n {
+			reservoir = append(reservoir, result{id: string(iter.Key()), document: document})
+		} else if i := random.Intn(seen); i < n {
+			reservoir[i] = result{id: string(iter.Key()), document: document}
+		}
+	}
+
+	return reservoir, iter.Error()
+}
+
+func (s server) sampleDocuments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n := 10
+	if param := r.URL.Query().Get("n"); param != "" {
+		var err error
+		n, err = strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			jsonResponse(w, r, nil, fmt.Errorf("Expected n to be a positive integer, got: %s", param))
+			return
+		}
+	}
+
+	results, err := s.sample(n, r.URL.Query().Get("includeDeleted") == "true")
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	documents := []any{}
+	for _, result := range results {
+		documents = append(documents, map[string]any{
+			"id":   result.id,
+			"body": s.redact(result.document),
+		})
+	}
+
+	jsonResponse(w, r, map[string]any{"documents": documents, "count": len(documents)}, nil)
+}
+
+// Returns the fields of matching documents as rows of the id followed
+// by each field's value, null where a document doesn't have it
+func (s server) columnValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected fields parameter"))
+		return
+	}
+
+	fields := strings.Split(param, ",")
+	var paths [][]string
+	for _, field := range fields {
+		if path, ok := s.aliases[field]; ok {
+			field = path
+		}
+
+		// Values of redacted fields are never returned
+		if coveredBy(field, s.redactions) {
+			jsonResponse(w, r, nil, fmt.Errorf("Field is redacted: %s", field))
+			return
+		}
+
+		paths = append(paths, strings.Split(field, "."))
+	}
+
+	q, err := s.parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	plan, err := s.planQuery(q, false)
+	if err == nil {
+		err = s.checkScan(plan)
+	}
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	results, _, err := s.search(q, plan)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+	sortResults(results, nil)
+
+	rows := [][]any{}
+	for _, result := range results {
+		// Fields can be objects holding redacted fields
+		document := s.redact(result.document)
+		row := []any{result.id}
+		for _, path := range paths {
+			value, _ := getPath(document, path)
+			row = append(row, value)
+		}
+		rows = append(rows, row)
+	}
+
+	jsonResponse(w, r, map[string]any{"fields": fields, "rows": rows}, nil)
+}
+
+func (s server) distinctValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected field parameter"))
+		return
+	}
+
+	if path, ok := s.aliases[field]; ok {
+		field = path
+	}
+
+	// Values of redacted fields are never returned
+	if coveredBy(field, s.redactions) {
+		jsonResponse(w, r, nil, fmt.Errorf("Field is redacted: %s", field))
+		return
+	}
+
+	values, err := s.distinct(field)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"values": values,
+	}, nil)
+}
+
+// Counts the distinct values of the field. Indexed fields are counted
+// as they're indexed, others by reading every document.
+func (s server) countDistinct(field string) (int64, error) {
+	if s.valuesIndexed(field) {
+		return s.cardinality.get(field), nil
+	}
+
+	values, err := s.scanValues(field)
+	return int64(len(values)), err
+}
+
+// The values of the field in every document, formatted as the index
+// would
+func (s server) scanValues(field string) (map[string]bool, error) {
+	values := map[string]bool{}
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil {
+			return nil, err
+		}
+
+		if isDeleted(document) {
+			continue
+		}
 
-				idsArgumentCount[id]++
+		for _, pv := range getPathValuePairs(document, "") {
+			if pv.path == field {
+				values[fmt.Sprintf("%v", pv.value)] = true
 			}
-		} else {
-			isRange = true
 		}
 	}
 
-	var idsInAll []string
-	for id, count := range idsArgumentCount {
-		if count == nonRangeArguments {
-			idsInAll = append(idsInAll, id)
-		}
+	return values, iter.Error()
+}
+
+func (s server) cardinalityValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected field parameter"))
+		return
 	}
 
-	var documents []any
-	if r.URL.Query().Get("skipIndex") == "true" {
-		idsInAll = nil
+	if path, ok := s.aliases[field]; ok {
+		field = path
+	}
+
+	count, err := s.countDistinct(field)
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"cardinality": count,
+	}, nil)
+}
+
+// Shows the ids stored under an index key, for debugging the index
+func (s server) getIndexEntry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// Paths can't contain '=' here but values can
+	path, value, ok := strings.Cut(r.URL.Query().Get("pathValue"), "=")
+	if !ok {
+		jsonResponse(w, r, nil, fmt.Errorf("Expected pathValue parameter like path=value"))
+		return
+	}
+
+	ids, err := s.lookup(indexKey(path, value))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	if ids == nil {
+		ids = []string{}
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"key": indexKey(path, value),
+		"ids": ids,
+	}, nil)
+}
+
+// How many offending ids the consistency check returns of each kind
+const consistencySampleSize = 10
+
+type consistencyReport struct {
+	// Index entries for documents that don't exist or are deleted
+	dangling    int
+	danglingIds []string
+	// Index keys a document should be found by but isn't
+	missing    int
+	missingIds []string
+}
+
+// Cross-checks the index against the documents in both directions
+func (s server) checkConsistency() (consistencyReport, error) {
+	var report consistencyReport
+	if s.indexWriter != nil {
+		s.indexWriter.flush()
 	}
-	if len(idsInAll) > 0 {
-		for _, id := range idsInAll {
-			document, err := s.getDocumentById([]byte(id))
-			if err != nil {
-				jsonResponse(w, nil, err)
-				return
-			}
 
-			if !isRange || q.match(document) {
-				documents = append(documents, map[string]any{
-					"id":   id,
-					"body": document,
-				})
+	sample := func(ids []string, id string) []string {
+		if len(ids) >= consistencySampleSize {
+			return ids
+		}
+		for _, existing := range ids {
+			if existing == id {
+				return ids
 			}
 		}
-	} else {
-		iter := s.db.NewIter(nil)
-		defer iter.Close()
-		for iter.First(); iter.Valid(); iter.Next() {
-			var document map[string]any
-			err = json.Unmarshal(iter.Value(), &document)
+		return append(ids, id)
+	}
+
+	live := map[string]bool{}
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document map[string]any
+		err := s.unmarshal(iter.Value(), &document)
+		if err != nil || document == nil || isDeleted(document) {
+			continue
+		}
+
+		id := string(iter.Key())
+		live[id] = true
+		for _, key := range s.indexKeys(document) {
+			ids, err := s.lookup(key)
 			if err != nil {
-				jsonResponse(w, nil, err)
-				return
+				return report, err
 			}
 
-			if q.match(document) {
-				documents = append(documents, map[string]any{
-					"id":   string(iter.Key()),
-					"body": document,
-				})
+			// Postings are sorted
+			if i := sort.SearchStrings(ids, id); i == len(ids) || ids[i] != id {
+				report.missing++
+				report.missingIds = sample(report.missingIds, id)
 			}
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return report, err
+	}
 
-	jsonResponse(w, map[string]any{"documents": documents, "count": len(documents)}, nil)
-}
+	indexIter := s.indexDb.NewIter(nil)
+	defer indexIter.Close()
+	for indexIter.First(); indexIter.Valid(); indexIter.Next() {
+		// Meta keys don't hold postings
+		if bytes.HasPrefix(indexIter.Key(), []byte("\x00meta\x00")) {
+			continue
+		}
 
-func (s server) getDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	id := ps.ByName("id")
+		for _, id := range decodePostings(indexIter.Value()) {
+			if !live[id] {
+				report.dangling++
+				report.danglingIds = sample(report.danglingIds, id)
+			}
+		}
+	}
 
-	document, err := s.getDocumentById([]byte(id))
+	return report, indexIter.Error()
+}
+
+func (s server) getConsistency(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report, err := s.checkConsistency()
 	if err != nil {
-		jsonResponse(w, nil, err)
+		jsonResponse(w, r, nil, err)
 		return
 	}
 
-	jsonResponse(w, map[string]any{
-		"document": document,
+	if report.danglingIds == nil {
+		report.danglingIds = []string{}
+	}
+	if report.missingIds == nil {
+		report.missingIds = []string{}
+	}
+
+	jsonResponse(w, r, map[string]any{
+		"consistent":  report.dangling == 0 && report.missing == 0,
+		"dangling":    report.dangling,
+		"danglingIds": report.danglingIds,
+		"missing":     report.missing,
+		"missingIds":  report.missingIds,
 	}, nil)
 }
 
-func (s server) reindex() {
-	iter := s.db.NewIter(nil)
-	defer iter.Close()
-	for iter.First(); iter.Valid(); iter.Next() {
-		var document map[string]any
-		err := json.Unmarshal(iter.Value(), &document)
+func handlePanic(w http.ResponseWriter, r *http.Request, recovered any) {
+	log.Printf("Panic handling %s %s: %v\n%s", r.Method, r.URL, recovered, debug.Stack())
+	jsonResponse(w, r, nil, apiError{http.StatusInternalServerError, "internal", fmt.Errorf("Internal server error")})
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Requires a static bearer token on requests
+type tokenAuth struct {
+	token        []byte
+	mutatingOnly bool // Let GET and HEAD requests through without the token
+}
+
+func newTokenAuth(token string, mutatingOnly bool) *tokenAuth {
+	return &tokenAuth{token: []byte(token), mutatingOnly: mutatingOnly}
+}
+
+func (a *tokenAuth) authorized(r *http.Request) bool {
+	if a.mutatingOnly && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return true
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), a.token) == 1
+}
+
+func (a *tokenAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			jsonResponse(w, r, nil, apiError{http.StatusUnauthorized, "unauthorized", fmt.Errorf("Missing or invalid bearer token")})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Per-IP token bucket rate limiter
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Tokens added per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget clients whose buckets have refilled so the map doesn't
+	// grow forever
+	if len(l.buckets) > 10000 {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
-			log.Printf("Unable to parse bad document, %s: %s", string(iter.Key()), err)
+			ip = r.RemoteAddr
 		}
-		s.index(string(iter.Key()), document)
+
+		if !l.allow(ip, time.Now()) {
+			jsonResponse(w, r, nil, apiError{http.StatusTooManyRequests, "rate_limited", fmt.Errorf("Too many requests")})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits how many requests are handled at once. Excess requests wait
+// up to timeout for a slot and are rejected after that.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newConcurrencyLimiter(limit int, timeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, limit), timeout: timeout}
+}
+
+func (l *concurrencyLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
 	}
 }
 
-func main() {
-	s, err := newServer("docdb.data", "8080")
+func (l *concurrencyLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire() {
+			jsonResponse(w, r, nil, apiError{http.StatusServiceUnavailable, "overloaded", fmt.Errorf("Too many concurrent requests")})
+			return
+		}
+		defer func() {
+			<-l.slots
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Named collections of documents, each in its own pair of databases
+// under dir and configured like the server serving them. Collections
+// are opened the first time they're used and stay open.
+type collections struct {
+	mu  sync.Mutex
+	dir string
+	// How long each collection's index writer batches updates for, 0
+	// updates the index synchronously
+	indexBatchWindow time.Duration
+	open             map[string]*collection
+}
+
+type collection struct {
+	s      *server
+	router http.Handler
+}
+
+func newCollections(dir string, indexBatchWindow time.Duration) *collections {
+	return &collections{dir: dir, indexBatchWindow: indexBatchWindow, open: map[string]*collection{}}
+}
+
+var collectionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Returns the named collection, opening it with the configuration of
+// template if it isn't open yet
+func (c *collections) get(template server, name string) (*collection, error) {
+	if !collectionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("Expected collection name of up to 64 letters, digits, dashes and underscores, got: %s", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if open, ok := c.open[name]; ok {
+		return open, nil
+	}
+
+	err := os.MkdirAll(c.dir, 0755)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer s.db.Close()
 
-	s.reindex()
+	opened, err := newServer(c.dir+"/"+name, template.port)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the configuration is shared, everything tied to the
+	// databases is the collection's own
+	s := template
+	s.db, s.indexDb = opened.db, opened.indexDb
+	s.metrics = opened.metrics
+	s.indexLock = opened.indexLock
+	s.insertLock = opened.insertLock
+	s.unindexed = opened.unindexed
+	s.cardinality = opened.cardinality
+	s.postingsKeys = opened.postingsKeys
+	s.insertions = opened.insertions
+	s.wal = nil
+	s.indexWriter = nil
+	s.collections = nil
+	if template.cache != nil {
+		s.cache = newResultCache(template.cache.ttl)
+	}
+
+	// The index wasn't checked so it mustn't be marked clean
+	abort := func(err error) (*collection, error) {
+		if s.indexWriter != nil {
+			s.indexWriter.close()
+		}
+		if s.wal != nil {
+			s.wal.close()
+		}
+		s.db.Close()
+		s.indexDb.Close()
+		return nil, err
+	}
+
+	// With -wal each collection logs its writes next to its databases
+	if template.wal != nil {
+		s.wal, err = openWriteAheadLog(c.dir+"/"+name+".wal", template.wal.checkpointEvery)
+		if err != nil {
+			return abort(err)
+		}
+
+		replayed, err := s.replayWriteAheadLog()
+		if err != nil {
+			return abort(err)
+		}
+		if replayed > 0 {
+			log.Printf("Replayed %d writes to collection %s from the write-ahead log", replayed, name)
+		}
+	}
+
+	if c.indexBatchWindow > 0 {
+		s.indexWriter = newIndexWriter(s, c.indexBatchWindow)
+	}
+
+	_, err = s.checkIndex(false)
+	if err != nil {
+		return abort(err)
+	}
+
+	open := &collection{s: &s, router: s.routes()}
+	c.open[name] = open
+	return open, nil
+}
+
+func (c *collections) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, open := range c.open {
+		open.s.close()
+		delete(c.open, name)
+	}
+}
+
+// Serves /collections/:name/*path with the collection's own routes,
+// e.g. /collections/users/docs is /docs of the users collection
+func (s server) serveCollection(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	open, err := s.collections.get(s, ps.ByName("name"))
+	if err != nil {
+		jsonResponse(w, r, nil, err)
+		return
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.Path = ps.ByName("path")
+	r.URL.RawPath = ""
+	open.router.ServeHTTP(w, r)
+}
+
+// Query parameters of each operation, keyed by route then method, for
+// OPTIONS to describe. Which methods are allowed comes from the
+// registered routes.
+var routeParameters = map[string]map[string][]string{
+	"/docs": {
+		"GET":   {"q", "limit", "order", "sort", "shape", "format", "explain", "exactTotal", "includeDeleted", "skipIndex", "wait", "debug", "flatten", "missing"},
+		"HEAD":  {"q", "includeDeleted", "skipIndex", "wait"},
+		"POST":  {"unlessExists"},
+		"PATCH": {"q", "all"},
+	},
+	"/docs/:id": {
+		"GET": {"includeDeleted", "flatten"},
+	},
+	"/docs/:id/raw": {
+		"GET": {"includeDeleted"},
+	},
+	"/docs/distinct": {
+		"GET": {"field"},
+	},
+	"/docs/facets": {
+		"GET": {"field", "q"},
+	},
+	"/docs/cardinality": {
+		"GET": {"field"},
+	},
+	"/docs/sample": {
+		"GET": {"n", "includeDeleted"},
+	},
+	"/docs/columns": {
+		"GET": {"fields", "q"},
+	},
+	"/import": {
+		"POST": {"idField"},
+	},
+	"/admin/index": {
+		"GET": {"pathValue"},
+	},
+}
+
+// The routeParameters route the path falls under, literal routes
+// before ones with parameters
+func routeOf(path string) string {
+	if _, ok := routeParameters[path]; ok {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	for route := range routeParameters {
+		routeSegments := strings.Split(route, "/")
+		if len(routeSegments) != len(segments) {
+			continue
+		}
+
+		matched := true
+		for i, segment := range routeSegments {
+			if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route
+		}
+	}
+
+	return ""
+}
+
+// Answers OPTIONS requests, after the router has set the Allow header
+// to the methods registered for the path
+func describeRoute(w http.ResponseWriter, r *http.Request) {
+	parameters := routeParameters[routeOf(r.URL.Path)]
+	var operations []map[string]any
+	for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+		if method == http.MethodOptions {
+			continue
+		}
+
+		params := parameters[method]
+		if params == nil {
+			params = []string{}
+		}
+		operations = append(operations, map[string]any{
+			"method":     method,
+			"parameters": params,
+		})
+	}
+
+	jsonResponse(w, r, map[string]any{"operations": operations}, nil)
+}
+
+// Answers methods only some of the dispatched names support, e.g.
+// POST on a document id
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jsonResponse(w, r, nil, apiError{http.StatusMethodNotAllowed, "method_not_allowed", fmt.Errorf("Method %s not allowed on %s", r.Method, r.URL.Path)})
+}
+
+// httprouter doesn't allow static routes next to a wildcard so named
+// endpoints like /docs/distinct are dispatched from the /docs/:id route
+func dispatch(named map[string]httprouter.Handle, fallback httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if handle, ok := named[ps.ByName("id")]; ok {
+			handle(w, r, ps)
+			return
+		}
+
+		fallback(w, r, ps)
+	}
+}
 
+func (s server) routes() *httprouter.Router {
 	router := httprouter.New()
+	router.PanicHandler = handlePanic
+	router.GlobalOPTIONS = http.HandlerFunc(describeRoute)
 	router.POST("/docs", s.addDocument)
+	// Static POST /docs/... routes would conflict with :id
+	router.POST("/docs/:id", dispatch(map[string]httprouter.Handle{
+		"validate-query": s.validateQuery,
+		"batch-delete":   s.batchDeleteDocuments,
+	}, methodNotAllowed))
+	router.POST("/docs/:id/append", s.appendDocument)
 	router.GET("/docs", s.searchDocuments)
-	router.GET("/docs/:id", s.getDocument)
+	router.HEAD("/docs", s.searchDocuments)
+	router.GET("/docs/:id", dispatch(map[string]httprouter.Handle{
+		"distinct":    s.distinctValues,
+		"facets":      s.facetValues,
+		"cardinality": s.cardinalityValues,
+		"sample":      s.sampleDocuments,
+		"columns":     s.columnValues,
+	}, s.getDocument))
+	router.GET("/docs/:id/raw", s.getRawDocument)
+	router.GET("/docs/:id/pathvalues", s.getPathValues)
+	router.PATCH("/docs", s.patchDocuments)
+	router.PATCH("/docs/:id", s.patchDocument)
+	router.PUT("/docs/:id", s.putDocument)
+	router.DELETE("/docs/:id", s.deleteDocument)
+	router.GET("/metrics", s.getMetrics)
+	router.POST("/reindex", s.reindexDocuments)
+	router.POST("/import", s.importDocuments)
+	router.POST("/purge", s.purgeDocuments)
+	router.GET("/version", s.getVersion)
+	if s.admin {
+		router.GET("/admin/index", s.getIndexEntry)
+		router.GET("/admin/consistency", s.getConsistency)
+	}
+	if s.collections != nil {
+		for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+			router.Handle(method, "/collections/:name/*path", s.serveCollection)
+		}
+	}
+
+	return router
+}
+
+// How long shutting down waits for requests in flight
+const shutdownTimeout = 30 * time.Second
+
+// Serves until ctx is done, then stops accepting requests, waits for
+// the ones in flight and closes the databases so the index is marked
+// as cleanly shut down
+func (s server) serve(ctx context.Context, httpServer *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		s.close()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	s.close()
+	return err
+}
+
+func main() {
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second allowed from each client IP, 0 disables rate limiting")
+	rateBurst := flag.Int("rate-burst", 10, "Requests a client IP can make in a burst above the rate limit")
+	useNumber := flag.Bool("use-number", false, "Preserve JSON numbers exactly instead of converting them to float64")
+	maxResults := flag.Int("max-results", 0, "Fail searches matching more than this many documents, 0 means no limit")
+	noScan := flag.Bool("no-scan", false, "Fail queries that can't be answered from the index instead of scanning every document")
+	maxQueryTerms := flag.Int("max-query-terms", 0, "Reject queries with more than this many comparisons, 0 means no limit")
+	aliasesFile := flag.String("aliases", "", "JSON file mapping query key aliases to dotted paths")
+	buckets := flag.String("index-buckets", "", "Comma separated path=width of numeric fields to also index into buckets of that width for range queries, e.g. price=100")
+	schemaFile := flag.String("schema", "", "JSON file mapping dotted paths to number, string, bool or date to index and compare their values as")
+	wrapNonObjects := flag.Bool("wrap-non-objects", false, "Store JSON arrays and scalars under the _value key instead of rejecting them")
+	redact := flag.String("redact", "", "Comma separated dotted paths to remove from documents before returning them")
+	redactMask := flag.String("redact-mask", "", "Replace redacted values with this instead of removing them")
+	tokenizedFields := flag.String("tokenize", "", "Comma separated dotted paths of string fields to index by word, * for all")
+	indexInclude := flag.String("index-include", "", "Comma separated dotted paths to index, other fields can only be searched by scanning")
+	indexExclude := flag.String("index-exclude", "", "Comma separated dotted paths to leave out of the index")
+	normalize := flag.Bool("normalize-unicode", false, "Index and query strings in Unicode normal form C")
+	cacheTTL := flag.Duration("cache-ttl", 0, "Cache search responses for this long or until the next write, 0 disables the cache")
+	defaultField := flag.String("default-field", "", "Dotted path that query values without a key are compared against, e.g. name so that foo means name:foo")
+	missingRange := flag.String("missing-range", "exclude", "How range comparisons treat documents missing the key by default, exclude or min to treat it as negative infinity")
+	slowQuery := flag.Duration("slow-query", 0, "Log searches taking longer than this with how they ran, 0 disables the log")
+	indexBatchWindow := flag.Duration("index-batch-window", 0, "Update the index in the background, batching updates made within this long of each other, 0 updates it synchronously")
+	collectionsDir := flag.String("collections", "", "Directory to store collections served under /collections/:name/ in, empty disables collections")
+	reindexOnStart := flag.Bool("reindex-on-start", false, "Rebuild the index from the documents on startup even if it looks up to date")
+	lazyIndex := flag.Bool("lazy-index", false, "Don't index inserted documents until POST /reindex, searches scan until then")
+	maxConcurrency := flag.Int("max-concurrency", 0, "Requests handled at once, 0 means no limit")
+	concurrencyWait := flag.Duration("concurrency-wait", time.Second, "How long a request waits for a slot under -max-concurrency before failing with 503")
+	readTimeout := flag.Duration("read-timeout", 0, "Maximum duration for reading a request, 0 means no limit")
+	writeTimeout := flag.Duration("write-timeout", 0, "Maximum duration for writing a response, 0 means no limit")
+	softDelete := flag.Bool("soft-delete", false, "Keep deleted documents marked with _deleted until POST /purge")
+	indexSync := flag.Bool("index-sync", true, "Fsync index updates, if false the index is rebuilt on startup after a crash")
+	binaryPostings := flag.Bool("binary-postings", false, "Store index postings as binary uuids, existing text postings are converted as they are updated")
+	maxIndexedLength := flag.Int("max-indexed-length", 0, "Don't index strings longer than this many bytes for exact matches, searches for them scan instead, 0 means no limit")
+	maxCardinality := flag.Int64("max-field-cardinality", 0, "Stop indexing fields with more than this many distinct values, searches on them scan instead, 0 means no limit")
+	wal := flag.Bool("wal", false, "Log document writes to docdb.data.wal before applying them and replay the log on startup")
+	walCheckpoint := flag.Int("wal-checkpoint", 1000, "Truncate the write-ahead log after this many writes")
+	idFormat := flag.String("id-format", "v4", "Generate random UUIDv4 ids, or v7 for UUIDv7 ids that sort in insertion order")
+	strictJSON := flag.Bool("strict-json", false, "Reject documents with duplicate keys or data after the document")
+	maxDocumentSize := flag.Int("max-document-size", 0, "Reject documents larger than this many bytes once encoded for storage, 0 means no limit")
+	maxDepth := flag.Int("max-depth", 0, "Reject documents with objects and arrays nested deeper than this, 0 means no limit")
+	admin := flag.Bool("admin", false, "Serve the /admin debugging endpoints")
+	token := flag.String("token", "", "Require this bearer token in the Authorization header, empty disables authentication")
+	tokenMutatingOnly := flag.Bool("token-mutating-only", false, "Only require -token on requests that aren't GET or HEAD")
+	idleTimeout := flag.Duration("idle-timeout", 0, "How long keep-alive connections stay open between requests, 0 means the read timeout")
+	keepAlives := flag.Bool("keep-alives", true, "Keep connections open between requests")
+	flag.Parse()
+
+	s, err := newServer("docdb.data", "8080")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.useNumber = *useNumber
+	s.maxResults = *maxResults
+	s.noScan = *noScan
+	s.maxQueryTerms = *maxQueryTerms
+	s.wrapNonObjects = *wrapNonObjects
+	s.normalize = *normalize
+	s.lazyIndex = *lazyIndex
+	s.admin = *admin
+	s.softDelete = *softDelete
+	s.indexSync = *indexSync
+	s.binaryPostings = *binaryPostings
+	s.maxCardinality = *maxCardinality
+	s.maxIndexedLength = *maxIndexedLength
+	s.maxDepth = *maxDepth
+	s.maxDocumentSize = *maxDocumentSize
+	s.slowQuery = *slowQuery
+	if *cacheTTL > 0 {
+		s.cache = newResultCache(*cacheTTL)
+	}
+	s.strictJSON = *strictJSON
+	switch *idFormat {
+	case "v4":
+	case "v7":
+		s.uuidV7 = &uuidV7Generator{}
+	default:
+		log.Fatalf("Unknown -id-format: %s", *idFormat)
+	}
+	if !missingPolicies[*missingRange] {
+		log.Fatalf("Unknown -missing-range: %s", *missingRange)
+	}
+	s.missingRange = *missingRange
+	s.defaultField = *defaultField
+	s.redactions = parseFields(*redact)
+	s.redactMask = *redactMask
+	s.tokenizedFields = parseFields(*tokenizedFields)
+	s.indexInclude = parseFields(*indexInclude)
+	s.indexExclude = parseFields(*indexExclude)
+	if len(s.indexInclude) > 0 && len(s.indexExclude) > 0 {
+		log.Fatal("Only one of -index-include and -index-exclude can be set")
+	}
+	if *aliasesFile != "" {
+		s.aliases, err = loadAliases(*aliasesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	s.buckets, err = parseBuckets(*buckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *schemaFile != "" {
+		s.schema, err = loadSchema(*schemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *indexBatchWindow > 0 {
+		s.indexWriter = newIndexWriter(*s, *indexBatchWindow)
+	}
+	if *collectionsDir != "" {
+		s.collections = newCollections(*collectionsDir, *indexBatchWindow)
+	}
+	if *wal {
+		s.wal, err = openWriteAheadLog("docdb.data.wal", *walCheckpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		replayed, err := s.replayWriteAheadLog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if replayed > 0 {
+			log.Printf("Replayed %d writes from the write-ahead log", replayed)
+		}
+	}
+
+	start := time.Now()
+	reindexed, err := s.checkIndex(*reindexOnStart)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reindexed {
+		log.Printf("Rebuilt the index in %s", time.Since(start))
+	}
+
+	var handler http.Handler = s.routes()
+	if *maxConcurrency > 0 {
+		handler = newConcurrencyLimiter(*maxConcurrency, *concurrencyWait).middleware(handler)
+	}
+	if *token != "" {
+		handler = newTokenAuth(*token, *tokenMutatingOnly).middleware(handler)
+	}
+	if *rateLimit > 0 {
+		handler = newRateLimiter(*rateLimit, *rateBurst).middleware(handler)
+	}
+
+	httpServer := &http.Server{
+		Addr:         ":" + s.port,
+		Handler:      handler,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	httpServer.SetKeepAlivesEnabled(*keepAlives)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Println("Listening on " + s.port)
-	log.Fatal(http.ListenAndServe(":"+s.port, router))
+	err = s.serve(ctx, httpServer)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
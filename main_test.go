@@ -1,9 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/pebble"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,6 +50,44 @@ func Test_getPath(t *testing.T) {
 			nil,
 			false,
 		},
+		{
+			map[string]any{
+				"items": []any{
+					map[string]any{"name": "foo"},
+					map[string]any{"name": "bar"},
+				},
+			},
+			[]string{"items", "1", "name"},
+			"bar",
+			true,
+		},
+		{
+			map[string]any{
+				"items": []any{
+					map[string]any{"name": "foo"},
+				},
+			},
+			[]string{"items", "1", "name"},
+			nil,
+			false,
+		},
+		{
+			map[string]any{
+				"items": []any{"foo"},
+			},
+			[]string{"items", "-1"},
+			nil,
+			false,
+		},
+		{
+			// Numeric keys of objects are still keys
+			map[string]any{
+				"a": map[string]any{"0": 1},
+			},
+			[]string{"a", "0"},
+			1,
+			true,
+		},
 	}
 
 	for _, test := range tests {
@@ -79,6 +133,27 @@ func Test_lexString(t *testing.T) {
 			2,
 			nil,
 		},
+		{
+			`http\://x.com:1`,
+			0,
+			"http://x.com",
+			13,
+			nil,
+		},
+		{
+			`a\ b`,
+			0,
+			"a b",
+			4,
+			nil,
+		},
+		{
+			`"say \"hi\" C:\path\\":1`,
+			0,
+			`say "hi" C:\path\`,
+			22,
+			nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -89,6 +164,18 @@ func Test_lexString(t *testing.T) {
 	}
 }
 
+func Test_parseQuery_escapedColon(t *testing.T) {
+	q, err := parseQuery(`url:http\://x.com\:8080 a\:b:c`)
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{
+		{key: []string{"url"}, value: "http://x.com:8080", op: "="},
+		{key: []string{"a:b"}, value: "c", op: "="},
+	}, q.ands)
+
+	assert.True(t, q.match("", map[string]any{"url": "http://x.com:8080", "a:b": "c"}))
+	assert.False(t, q.match("", map[string]any{"url": "http", "a:b": "c"}))
+}
+
 func Test_parseQuery(t *testing.T) {
 	tests := []struct {
 		q             string
@@ -98,7 +185,7 @@ func Test_parseQuery(t *testing.T) {
 		{
 			"a.b:1 c:>2",
 			query{
-				[]queryComparison{
+				ands: []queryComparison{
 					{
 						key:   []string{"a", "b"},
 						value: "1",
@@ -116,7 +203,7 @@ func Test_parseQuery(t *testing.T) {
 		{
 			"a:<1",
 			query{
-				[]queryComparison{
+				ands: []queryComparison{
 					{
 						key:   []string{"a"},
 						value: "1",
@@ -129,7 +216,7 @@ func Test_parseQuery(t *testing.T) {
 		{
 			`" a ":" n "`,
 			query{
-				[]queryComparison{
+				ands: []queryComparison{
 					{
 						key:   []string{" a "},
 						value: " n ",
@@ -139,6 +226,55 @@ func Test_parseQuery(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"a:>=1 b:<=2",
+			query{
+				ands: []queryComparison{
+					{
+						key:   []string{"a"},
+						value: "1",
+						op:    ">=",
+					},
+					{
+						key:   []string{"b"},
+						value: "2",
+						op:    "<=",
+					},
+				},
+			},
+			nil,
+		},
+		{
+			"a:1 AND (b:2 OR c:>3)",
+			query{
+				ands: []queryComparison{
+					{
+						key:   []string{"a"},
+						value: "1",
+						op:    "=",
+					},
+				},
+				ors: [][]query{
+					{
+						{ands: []queryComparison{{key: []string{"b"}, value: "2", op: "="}}},
+						{ands: []queryComparison{{key: []string{"c"}, value: "3", op: ">"}}},
+					},
+				},
+			},
+			nil,
+		},
+		{
+			"a:1 OR b:2 c:3",
+			query{
+				ors: [][]query{
+					{
+						{ands: []queryComparison{{key: []string{"a"}, value: "1", op: "="}}},
+						{ands: []queryComparison{{key: []string{"b"}, value: "2", op: "="}, {key: []string{"c"}, value: "3", op: "="}}},
+					},
+				},
+			},
+			nil,
+		},
 		{
 			"",
 			query{},
@@ -172,6 +308,16 @@ func Test_getPathValues(t *testing.T) {
 			"",
 			[]string{"a.12=19"},
 		},
+		{
+			map[string]any{"a": map[string]any{"b": map[string]any{"c": 1}}},
+			"",
+			[]string{"a.b.c=1"},
+		},
+		{
+			map[string]any{"tags": []any{"go", 1, map[string]any{"a": 1}, []any{"b"}}},
+			"",
+			[]string{"tags=go", "tags=1"},
+		},
 	}
 
 	for _, test := range tests {
@@ -180,3 +326,3687 @@ func Test_getPathValues(t *testing.T) {
 		assert.Equal(t, pvs, test.expectedPvs)
 	}
 }
+
+func newTestServer(t *testing.T) *server {
+	s, err := newServer(t.TempDir()+"/docdb.data", "8080")
+	assert.Nil(t, err)
+	t.Cleanup(s.close)
+	return s
+}
+
+type testResponse struct {
+	Body   map[string]any `json:"body"`
+	Status string         `json:"status"`
+	Error  string         `json:"error"`
+	Code   string         `json:"code"`
+}
+
+func decodeTestResponse(t *testing.T, w *httptest.ResponseRecorder) testResponse {
+	var res testResponse
+	err := json.NewDecoder(w.Body).Decode(&res)
+	assert.Nil(t, err)
+	return res
+}
+
+func addTestDocument(t *testing.T, s *server, document string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/docs", strings.NewReader(document))
+	s.addDocument(w, r, nil)
+
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	return res.Body["id"].(string)
+}
+
+func searchTestDocuments(t *testing.T, s *server, params url.Values) testResponse {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs?"+params.Encode(), nil)
+	s.searchDocuments(w, r, nil)
+	return decodeTestResponse(t, w)
+}
+
+func documentIds(res testResponse) []string {
+	documents, _ := res.Body["documents"].([]any)
+	var ids []string
+	for _, document := range documents {
+		ids = append(ids, document.(map[string]any)["id"].(string))
+	}
+	return ids
+}
+
+func Test_searchDocuments_slowQuery(t *testing.T) {
+	s := newTestServer(t)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 45}`)
+
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Nothing is logged while disabled
+	searchTestDocuments(t, s, url.Values{"q": {"age:>40"}})
+	assert.NotContains(t, logged.String(), "Slow query")
+
+	s.slowQuery = time.Nanosecond
+	searchTestDocuments(t, s, url.Values{"q": {"age:>40"}})
+	searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Contains(t, logged.String(), `WARN Slow query took `)
+	assert.Contains(t, logged.String(), `q="age:>40" usedIndex=false scanned=1`)
+	assert.Contains(t, logged.String(), `q="name:Kevin" usedIndex=true scanned=1`)
+}
+
+func Test_searchDocuments_debug(t *testing.T) {
+	s := newTestServer(t)
+	kevin := addTestDocument(t, s, `{"name": "Kevin", "age": 45}`)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 12}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin age:>40"}, "debug": {"true"}})
+	assert.Equal(t, []string{kevin}, documentIds(res))
+	document := res.Body["documents"].([]any)[0].(map[string]any)
+	assert.Equal(t, []any{
+		map[string]any{"key": "name", "op": "=", "value": "Kevin", "matched": true, "via": "index"},
+		map[string]any{"key": "age", "op": ">", "value": "40", "matched": true, "via": "match"},
+	}, document["debug"])
+
+	// Only one alternative of an OR has to match
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Bob OR age:>40"}, "debug": {"true"}})
+	assert.Equal(t, []string{kevin}, documentIds(res))
+	document = res.Body["documents"].([]any)[0].(map[string]any)
+	assert.Equal(t, []any{
+		map[string]any{"key": "name", "op": "=", "value": "Bob", "matched": false, "via": "match"},
+		map[string]any{"key": "age", "op": ">", "value": "40", "matched": true, "via": "match"},
+	}, document["debug"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	_, ok := res.Body["documents"].([]any)[0].(map[string]any)["debug"]
+	assert.False(t, ok)
+}
+
+func Test_searchDocuments_cache(t *testing.T) {
+	s := newTestServer(t)
+	s.cache = newResultCache(time.Minute)
+	kevin := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	params := url.Values{"q": {"name:Kevin"}}
+	res := searchTestDocuments(t, s, params)
+	assert.Equal(t, []string{kevin}, documentIds(res))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&s.metrics.cacheHits))
+
+	// Formatting params don't matter
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "pretty": {"true"}})
+	assert.Equal(t, []string{kevin}, documentIds(res))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.metrics.cacheHits))
+
+	// Writes invalidate it
+	other := addTestDocument(t, s, `{"name": "Kevin"}`)
+	res = searchTestDocuments(t, s, params)
+	assert.ElementsMatch(t, []string{kevin, other}, documentIds(res))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.metrics.cacheHits))
+
+	assert.Nil(t, s.delete(other))
+	res = searchTestDocuments(t, s, params)
+	assert.Equal(t, []string{kevin}, documentIds(res))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.metrics.cacheHits))
+
+	// A search that started before a write isn't cached
+	generation := s.cache.generation
+	s.cache.invalidate()
+	s.cache.put("q=stale", generation, map[string]any{})
+	_, _, ok := s.cache.get("q=stale")
+	assert.False(t, ok)
+
+	// Entries expire
+	s.cache.ttl = 0
+	searchTestDocuments(t, s, url.Values{"q": {"name:Sam"}})
+	searchTestDocuments(t, s, url.Values{"q": {"name:Sam"}})
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.metrics.cacheHits))
+}
+
+func Test_flatten(t *testing.T) {
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston", "geo": {"lat": 42.3}}, "tags": ["a", {"b": 1}], "meta": {}, "none": null}`)
+
+	expected := map[string]any{
+		"name":            "Kevin",
+		"address.city":    "Boston",
+		"address.geo.lat": 42.3,
+		"tags":            []any{"a", map[string]any{"b": 1.0}},
+		"meta":            map[string]any{},
+		"none":            nil,
+	}
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"address.city:Boston"}, "flatten": {"true"}})
+	document := res.Body["documents"].([]any)[0].(map[string]any)["body"].(map[string]any)
+	delete(document, "_created")
+	delete(document, "_updated")
+	assert.Equal(t, expected, document)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"?flatten=true", nil))
+	document = decodeTestResponse(t, w).Body["document"].(map[string]any)
+	delete(document, "_created")
+	delete(document, "_updated")
+	assert.Equal(t, expected, document)
+}
+
+func Test_searchDocuments_missing(t *testing.T) {
+	s := newTestServer(t)
+	young := addTestDocument(t, s, `{"age": 30}`)
+	old := addTestDocument(t, s, `{"age": 60}`)
+	missing := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	tests := []struct {
+		query       string
+		missing     string
+		expectedIds []string
+	}{
+		{"age:<50", "", []string{young}},
+		{"age:<50", "exclude", []string{young}},
+		{"age:<50", "min", []string{young, missing}},
+		{"age:<=50", "min", []string{young, missing}},
+		{"age:>50", "min", []string{old}},
+		{"age:between(20,50)", "min", []string{young}},
+		{"age:<50 OR name:Sam", "min", []string{young, missing}},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}, "missing": {test.missing}})
+		assert.ElementsMatch(t, test.expectedIds, documentIds(res), test.query+" "+test.missing)
+	}
+
+	// The server's default applies unless overridden, including when
+	// the index would otherwise narrow range queries down
+	s.missingRange = "min"
+	s.buckets = map[string]float64{"age": 10}
+	s.reindex()
+	res := searchTestDocuments(t, s, url.Values{"q": {"age:<50"}})
+	assert.ElementsMatch(t, []string{young, missing}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"age:<50"}, "missing": {"exclude"}})
+	assert.Equal(t, []string{young}, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"missing": {"max"}})
+	assert.Equal(t, "Expected missing to be exclude or min", res.Error)
+}
+
+func Test_searchDocuments_empty(t *testing.T) {
+	s := newTestServer(t)
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Nobody"}})
+	assert.Equal(t, []any{}, res.Body["documents"])
+	assert.Equal(t, float64(0), res.Body["count"])
+}
+
+func Test_searchDocuments_corrupt(t *testing.T) {
+	s := newTestServer(t)
+	kevin := addTestDocument(t, s, `{"name": "Kevin"}`)
+	assert.Nil(t, s.db.Set([]byte("corrupt"), []byte(`{"name": `), pebble.Sync))
+	assert.Nil(t, s.db.Set([]byte("scalar"), []byte(`5`), pebble.Sync))
+	assert.Nil(t, s.db.Set([]byte("null"), []byte(`null`), pebble.Sync))
+
+	// Both regexps and field comparisons scan every document
+	for _, q := range []string{"name:/^K/", "name:@name"} {
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.Equal(t, "", res.Error)
+		assert.Equal(t, []string{kevin}, documentIds(res), q)
+	}
+}
+
+func Test_searchDocuments_byId(t *testing.T) {
+	s := newTestServer(t)
+	kevin := addTestDocument(t, s, `{"name": "Kevin", "age": 45}`)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 12}`)
+
+	tests := []struct {
+		q           string
+		expectedIds []string
+	}{
+		{`_id:"` + kevin + `"`, []string{kevin}},
+		{`_id:"` + kevin + `" name:Kevin`, []string{kevin}},
+		{`_id:"` + kevin + `" name:Bob`, nil},
+		{`_id:"` + kevin + `" age:<20`, nil},
+		{`_id:nonexistent name:Kevin`, nil},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.q}})
+		assert.Equal(t, "ok", res.Status, res.Error)
+		assert.Equal(t, test.expectedIds, documentIds(res), test.q)
+	}
+}
+
+func Test_searchDocuments_explain(t *testing.T) {
+	s := newTestServer(t)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 45}`)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 12}`)
+	addTestDocument(t, s, `{"name": "Bob", "age": 30}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin age:>20"}, "explain": {"true"}})
+	assert.Equal(t, "ok", res.Status, res.Error)
+	explain := res.Body["explain"].(map[string]any)
+	assert.Equal(t, false, explain["fullScan"])
+	assert.Equal(t, 2.0, explain["estimatedDocuments"])
+	terms := explain["terms"].([]any)
+	assert.Equal(t, map[string]any{"key": "name", "op": "=", "value": "Kevin", "usedIndex": true, "candidates": 2.0}, terms[0])
+	assert.Equal(t, map[string]any{"key": "age", "op": ">", "value": "20", "usedIndex": false}, terms[1])
+	assert.Nil(t, res.Body["documents"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"age:>20"}, "explain": {"true"}})
+	explain = res.Body["explain"].(map[string]any)
+	assert.Equal(t, true, explain["fullScan"])
+	assert.Equal(t, 3.0, explain["estimatedDocuments"])
+}
+
+func Test_patchDocuments(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston", "zip": "02101"}}`)
+	b := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston"}}`)
+	c := addTestDocument(t, s, `{"name": "Bob", "address": {"city": "Boston"}}`)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/docs?q=name:Kevin", strings.NewReader(`{"address": {"city": "Denver"}}`))
+	s.patchDocuments(w, r, nil)
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, 2.0, res.Body["updated"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"address.city:Denver"}})
+	assert.ElementsMatch(t, []string{a, b}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"address.city:Boston"}})
+	assert.Equal(t, []string{c}, documentIds(res))
+
+	// Fields not in the patch are kept
+	res = searchTestDocuments(t, s, url.Values{"q": {"_id:" + a}})
+	documents := res.Body["documents"].([]any)
+	assert.Equal(t, map[string]any{"city": "Denver", "zip": "02101"}, documents[0].(map[string]any)["body"].(map[string]any)["address"])
+
+	// A query of only alternatives isn't empty
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PATCH", "/docs?"+url.Values{"q": {"name:Bob|Nobody"}}.Encode(), strings.NewReader(`{"address": {"city": "Austin"}}`))
+	s.patchDocuments(w, r, nil)
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, 1.0, res.Body["updated"])
+	res = searchTestDocuments(t, s, url.Values{"q": {"address.city:Austin"}})
+	assert.Equal(t, []string{c}, documentIds(res))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PATCH", "/docs?"+url.Values{"q": {"name:Bob OR name:Nobody"}}.Encode(), strings.NewReader(`{"address": {"city": "Dallas"}}`))
+	s.patchDocuments(w, r, nil)
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, 1.0, res.Body["updated"])
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PATCH", "/docs", strings.NewReader(`{"name": "Nobody"}`))
+	s.patchDocuments(w, r, nil)
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, "error", res.Status)
+}
+
+func Test_query_match_dates(t *testing.T) {
+	doc := map[string]any{"created": "2024-01-02T03:04:05Z", "name": "2024"}
+
+	tests := []struct {
+		q             string
+		expectedMatch bool
+	}{
+		{`created:>2024-01-01`, true},
+		{`created:<2024-01-01`, false},
+		{`created:>"2024-01-02T03:04:05Z"`, false},
+		{`created:>="2024-01-02T03:04:05Z"`, true},
+		{`created:<="2024-01-02T03:04:05Z"`, true},
+		{`created:<"2024-01-02T03:04:05Z"`, false},
+		{`created:<"2024-01-02T04:04:05+01:00"`, false},
+		{`created:<="2024-01-02T04:04:05+01:00"`, true},
+		{`created:<"2024-01-02T03:04:06Z"`, true},
+		// Non-date strings are still compared numerically
+		{`name:>2023`, true},
+		{`name:<2023`, false},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.q)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expectedMatch, q.match("", doc), test.q)
+	}
+}
+
+func Test_jsonResponse_pretty(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs/1", nil)
+	jsonResponse(w, r, map[string]any{"id": "1"}, nil)
+	assert.Equal(t, `{"body":{"id":"1"},"status":"ok"}`+"\n", w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/docs/1?pretty=true", nil)
+	jsonResponse(w, r, map[string]any{"id": "1"}, nil)
+	assert.Equal(t, "{\n  \"body\": {\n    \"id\": \"1\"\n  },\n  \"status\": \"ok\"\n}\n", w.Body.String())
+}
+
+func Test_jsonResponse_raw(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id, nil))
+	var enveloped map[string]any
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&enveloped))
+	assert.Equal(t, "ok", enveloped["status"])
+	assert.Equal(t, "Kevin", enveloped["body"].(map[string]any)["document"].(map[string]any)["name"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"?raw=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var raw map[string]any
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&raw))
+	assert.Nil(t, raw["status"])
+	assert.Equal(t, "Kevin", raw["document"].(map[string]any)["name"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/missing?raw=true", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, `{"code":"not_found","error":"Document not found: missing"}`+"\n", w.Body.String())
+}
+
+func Test_handlePanic(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		panic("oops")
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "error", res.Status)
+	assert.Equal(t, "Internal server error", res.Error)
+
+	// The server keeps working afterwards
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_searchDocuments_sort(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"lastName": "Smith", "age": 30}`)
+	b := addTestDocument(t, s, `{"lastName": "Jones", "age": 20}`)
+	c := addTestDocument(t, s, `{"lastName": "Smith", "age": 50}`)
+	d := addTestDocument(t, s, `{"lastName": "Smith"}`)
+	e := addTestDocument(t, s, `{"age": 10}`)
+
+	res := searchTestDocuments(t, s, url.Values{"sort": {"lastName,-age"}})
+	assert.Equal(t, []string{b, c, a, d, e}, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"sort": {"-lastName,age"}})
+	assert.Equal(t, []string{a, c, d, b, e}, documentIds(res))
+}
+
+func Test_searchDocuments_sortRelevance(t *testing.T) {
+	s := newTestServer(t)
+	title := addTestDocument(t, s, `{"title": "go", "body": "rust", "stars": 5}`)
+	both := addTestDocument(t, s, `{"title": "go", "body": "go", "stars": 1}`)
+	body := addTestDocument(t, s, `{"title": "rust", "body": "go", "stars": 3}`)
+	addTestDocument(t, s, `{"title": "rust", "body": "rust"}`)
+
+	q := "title:go OR body:go"
+	res := searchTestDocuments(t, s, url.Values{"q": {q}, "sort": {"relevance"}})
+	ids := documentIds(res)
+	assert.Equal(t, 3, len(ids))
+	assert.Equal(t, both, ids[0])
+
+	// Later keys break ties
+	res = searchTestDocuments(t, s, url.Values{"q": {q}, "sort": {"relevance,-stars"}})
+	assert.Equal(t, []string{both, title, body}, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"q": {q}, "sort": {"-relevance,stars"}, "limit": {"2"}})
+	assert.Equal(t, []string{body, title}, documentIds(res))
+}
+
+func Test_addDocument_timestamps(t *testing.T) {
+	s := newTestServer(t)
+	before := time.Now().UTC()
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	document, err := s.getDocumentById([]byte(id))
+	assert.Nil(t, err)
+	created, err := time.Parse(time.RFC3339Nano, document["_created"].(string))
+	assert.Nil(t, err)
+	assert.False(t, created.Before(before))
+	assert.Equal(t, document["_created"], document["_updated"])
+
+	// Timestamps are indexed
+	res := searchTestDocuments(t, s, url.Values{"q": {`_created:"` + document["_created"].(string) + `"`}, "explain": {"true"}})
+	explain := res.Body["explain"].(map[string]any)
+	assert.Equal(t, false, explain["fullScan"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {`_created:>="` + before.Format(time.RFC3339Nano) + `"`}})
+	assert.Equal(t, []string{id}, documentIds(res))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/docs/"+id, strings.NewReader(`{"_created": "2000-01-01"}`))
+	s.patchDocument(w, r, httprouter.Params{{Key: "id", Value: id}})
+	updated := decodeTestResponse(t, w).Body["document"].(map[string]any)
+	assert.Equal(t, document["_created"], updated["_created"])
+	assert.NotEqual(t, document["_updated"], updated["_updated"])
+}
+
+func Test_rateLimiter(t *testing.T) {
+	handler := newRateLimiter(1, 3).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var codes []int
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, []int{200, 200, 200, 429, 429}, codes)
+
+	// Other clients have their own bucket
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	// Tokens refill over time
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now))
+	assert.True(t, l.allow("a", now.Add(time.Second)))
+}
+
+func Test_searchDocuments_scanned(t *testing.T) {
+	s := newTestServer(t)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 45}`)
+	addTestDocument(t, s, `{"name": "Kevin", "age": 12}`)
+	addTestDocument(t, s, `{"name": "Bob", "age": 30}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"age:>40"}})
+	assert.Equal(t, 1.0, res.Body["count"])
+	assert.Equal(t, 3.0, res.Body["scanned"])
+
+	// Only the index candidates are read
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin age:>40"}})
+	assert.Equal(t, 1.0, res.Body["count"])
+	assert.Equal(t, 2.0, res.Body["scanned"])
+}
+
+func Test_useNumber(t *testing.T) {
+	s := newTestServer(t)
+	s.useNumber = true
+	id := addTestDocument(t, s, `{"big": 9007199254740993, "price": 0.1000000000000000055511151231257827}`)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs/"+id, nil)
+	s.getDocument(w, r, httprouter.Params{{Key: "id", Value: id}})
+	assert.Contains(t, w.Body.String(), `"big":9007199254740993`)
+	assert.Contains(t, w.Body.String(), `"price":0.1000000000000000055511151231257827`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"big:9007199254740993"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"big:>9007199254740000"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_parseQuery_errors(t *testing.T) {
+	tests := []struct {
+		q           string
+		expectedErr error
+	}{
+		{"(a:1", fmt.Errorf("Expected closing parenthesis at 4")},
+		{"a:1)", fmt.Errorf("Unexpected closing parenthesis at 3")},
+		{"a:1 OR", fmt.Errorf("Expected expression at 6")},
+		{"OR a:1", fmt.Errorf("Expected expression before OR at 0")},
+		{"()", fmt.Errorf("Expected expression at 1")},
+		{"a", fmt.Errorf("Expected colon at 1, got: ``")},
+	}
+
+	for _, test := range tests {
+		_, err := parseQuery(test.q)
+		assert.EqualError(t, err, test.expectedErr.Error(), test.q)
+	}
+}
+
+func Test_query_match_or(t *testing.T) {
+	tests := []struct {
+		doc           map[string]any
+		expectedMatch bool
+	}{
+		{map[string]any{"a": 1.0, "b": 2.0}, true},
+		{map[string]any{"a": 1.0, "c": 4.0}, true},
+		{map[string]any{"a": 1.0, "b": 3.0, "c": 3.0}, false},
+		{map[string]any{"a": 2.0, "b": 2.0}, false},
+	}
+
+	q, err := parseQuery("a:1 AND (b:2 OR c:>3)")
+	assert.Nil(t, err)
+	for _, test := range tests {
+		assert.Equal(t, test.expectedMatch, q.match("", test.doc), test.doc)
+	}
+}
+
+func Test_searchDocuments_or(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin", "city": "Boston"}`)
+	b := addTestDocument(t, s, `{"name": "Kevin", "city": "Denver"}`)
+	addTestDocument(t, s, `{"name": "Kevin", "city": "Austin"}`)
+	d := addTestDocument(t, s, `{"name": "Bob", "city": "Denver", "age": 12}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin (city:Boston OR city:Denver)"}})
+	assert.ElementsMatch(t, []string{a, b}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	// An alternative that can't use the index forces a scan
+	res = searchTestDocuments(t, s, url.Values{"q": {"city:Boston OR age:<20"}})
+	assert.ElementsMatch(t, []string{a, d}, documentIds(res))
+	assert.Equal(t, 4.0, res.Body["scanned"])
+}
+
+func Test_getMetrics(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addTestDocument(t, s, `{"name": "Kevin"}`)
+			searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+		}()
+	}
+	wg.Wait()
+	searchTestDocuments(t, s, url.Values{"q": {"name:Kevin (a:1 OR b:2)"}})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE docdb_documents_total gauge\ndocdb_documents_total 10\n")
+	assert.Contains(t, body, "\ndocdb_inserts_total 10\n")
+	assert.Contains(t, body, "\ndocdb_searches_total 11\n")
+	assert.Contains(t, body, "\ndocdb_index_lookups_total 13\n")
+	assert.Contains(t, body, "# TYPE docdb_search_duration_seconds histogram\n")
+	assert.Contains(t, body, "\ndocdb_search_duration_seconds_bucket{le=\"+Inf\"} 11\n")
+	assert.Contains(t, body, "\ndocdb_search_duration_seconds_count 11\n")
+}
+
+func Test_searchDocuments_stableOrder(t *testing.T) {
+	s := newTestServer(t)
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, addTestDocument(t, s, `{"name": "Kevin"}`))
+	}
+	sort.Strings(ids)
+
+	for i := 0; i < 5; i++ {
+		res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+		assert.Equal(t, ids, documentIds(res))
+		res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "skipIndex": {"true"}})
+		assert.Equal(t, ids, documentIds(res))
+	}
+}
+
+func Test_searchDocuments_maxResults(t *testing.T) {
+	s := newTestServer(t)
+	s.maxResults = 2
+	for i := 0; i < 3; i++ {
+		addTestDocument(t, s, `{"name": "Kevin"}`)
+	}
+	addTestDocument(t, s, `{"name": "Bob"}`)
+
+	for _, params := range []url.Values{{}, {"q": {"name:Kevin"}}} {
+		res := searchTestDocuments(t, s, params)
+		assert.Equal(t, "error", res.Status)
+		assert.Equal(t, "Query matched more than the maximum of 2 documents", res.Error)
+	}
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Bob"}})
+	assert.Equal(t, "ok", res.Status)
+	assert.Equal(t, 1.0, res.Body["count"])
+}
+
+func Test_searchDocuments_noScan(t *testing.T) {
+	s := newTestServer(t)
+	s.noScan = true
+	addTestDocument(t, s, `{"name": "Kevin", "age": 30}`)
+	addTestDocument(t, s, `{"name": "Bob", "age": 50}`)
+
+	// Range only queries and skipping the index would read everything
+	for _, params := range []url.Values{{"q": {"age:>40"}}, {"q": {"name:Bob"}, "skipIndex": {"true"}}} {
+		res := searchTestDocuments(t, s, params)
+		assert.Equal(t, "error", res.Status, params)
+		assert.Equal(t, "Query can't be answered from the index and full scans are disabled", res.Error)
+		assert.Equal(t, "scan_disabled", res.Code)
+	}
+
+	// Narrowing the range down with the index is fine
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Bob age:>40"}})
+	assert.Equal(t, "ok", res.Status)
+	assert.Equal(t, 1.0, res.Body["count"])
+
+	// explain still says why
+	res = searchTestDocuments(t, s, url.Values{"q": {"age:>40"}, "explain": {"true"}})
+	assert.Equal(t, true, res.Body["explain"].(map[string]any)["fullScan"])
+}
+
+func Test_searchDocuments_aliases(t *testing.T) {
+	file := t.TempDir() + "/aliases.json"
+	err := os.WriteFile(file, []byte(`{"city": "address.location.city"}`), 0644)
+	assert.Nil(t, err)
+
+	s := newTestServer(t)
+	s.aliases, err = loadAliases(file)
+	assert.Nil(t, err)
+
+	boston := addTestDocument(t, s, `{"address": {"location": {"city": "Boston"}}}`)
+	addTestDocument(t, s, `{"address": {"location": {"city": "Denver"}}}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"city:Boston"}})
+	assert.Equal(t, []string{boston}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin OR city:Boston"}})
+	assert.Equal(t, []string{boston}, documentIds(res))
+}
+
+func Test_addDocument_nonObject(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, body := range []string{`[1, 2]`, `"Kevin"`, `12`, `null`} {
+		w := httptest.NewRecorder()
+		s.addDocument(w, httptest.NewRequest("POST", "/docs", strings.NewReader(body)), nil)
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "error", res.Status)
+		assert.Equal(t, "document must be a JSON object", res.Error)
+	}
+
+	// Malformed JSON still reports the decode error
+	w := httptest.NewRecorder()
+	s.addDocument(w, httptest.NewRequest("POST", "/docs", strings.NewReader(`{"a":`)), nil)
+	assert.Equal(t, "unexpected EOF", decodeTestResponse(t, w).Error)
+
+	s.wrapNonObjects = true
+	array := addTestDocument(t, s, `["a", "b"]`)
+	scalar := addTestDocument(t, s, `"Kevin"`)
+
+	document, err := s.getDocumentById([]byte(array))
+	assert.Nil(t, err)
+	assert.Equal(t, []any{"a", "b"}, document["_value"])
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"_value:Kevin"}})
+	assert.Equal(t, []string{scalar}, documentIds(res))
+}
+
+func Test_searchDocuments_tokenized(t *testing.T) {
+	s := newTestServer(t)
+	s.tokenizedFields = map[string]bool{"description": true}
+	engine := addTestDocument(t, s, `{"description": "A fast Database engine.", "name": "a fast database engine"}`)
+	exact := addTestDocument(t, s, `{"description": "database"}`)
+	addTestDocument(t, s, `{"description": "a slow cache"}`)
+
+	tests := []struct {
+		q           string
+		expectedIds []string
+	}{
+		{"description:database", []string{engine, exact}},
+		{"description:DATABASE", []string{engine, exact}},
+		{`description:"fast database"`, []string{engine}},
+		{`description:"fast cache"`, nil},
+		// Other fields aren't tokenized
+		{"name:database", nil},
+	}
+
+	for _, test := range tests {
+		expected := append([]string{}, test.expectedIds...)
+		sort.Strings(expected)
+		if len(expected) == 0 {
+			expected = nil
+		}
+
+		res := searchTestDocuments(t, s, url.Values{"q": {test.q}})
+		assert.Equal(t, expected, documentIds(res), test.q)
+		res = searchTestDocuments(t, s, url.Values{"q": {test.q}, "skipIndex": {"true"}})
+		assert.Equal(t, expected, documentIds(res), test.q)
+	}
+
+	// Numbers and bools of tokenized fields are still found exactly
+	s.tokenizedFields = map[string]bool{"*": true}
+	number := addTestDocument(t, s, `{"age": 12, "ok": true, "note": "12 monkeys"}`)
+	other := addTestDocument(t, s, `{"age": 13, "ok": false, "note": "12"}`)
+	for q, expected := range map[string][]string{
+		"age:12":  {number},
+		"ok:true": {number},
+		"note:12": {number, other},
+	} {
+		sort.Strings(expected)
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.Equal(t, expected, documentIds(res), q)
+		res = searchTestDocuments(t, s, url.Values{"q": {q}, "skipIndex": {"true"}})
+		assert.Equal(t, expected, documentIds(res), q)
+	}
+}
+
+func Test_errorCodes(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+
+	tests := []struct {
+		method         string
+		url            string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"GET", "/docs?q=" + url.QueryEscape("a:1)"), "", 400, "invalid_query"},
+		{"GET", "/docs/missing", "", 404, "not_found"},
+		{"PATCH", "/docs/missing", "{}", 404, "not_found"},
+		{"POST", "/docs", "[]", 400, "invalid_document"},
+		{"POST", "/docs", "{", 400, "bad_request"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.url, strings.NewReader(test.body)))
+		assert.Equal(t, test.expectedStatus, w.Code, test.url)
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "error", res.Status)
+		assert.Equal(t, test.expectedCode, res.Code, test.url)
+	}
+}
+
+func Test_distinctValues(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	for _, status := range []string{"pending", "active", "active", "trial"} {
+		addTestDocument(t, s, `{"status": "`+status+`", "statuses": "x", "meta": {"status": "nested"}}`)
+	}
+	addTestDocument(t, s, `{"other": 1}`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/distinct?field=status", nil))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, []any{"active", "pending", "trial"}, res.Body["values"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/distinct?field=meta.status", nil))
+	assert.Equal(t, []any{"nested"}, decodeTestResponse(t, w).Body["values"])
+}
+
+func Test_searchDocuments_normalize(t *testing.T) {
+	composed := "café"
+	decomposed := "café"
+
+	s := newTestServer(t)
+	s.normalize = true
+	s.tokenizedFields = map[string]bool{"description": true}
+	a := addTestDocument(t, s, `{"name": "`+composed+`", "description": "a `+decomposed+` in Paris"}`)
+	b := addTestDocument(t, s, `{"name": "`+decomposed+`", "description": "a `+composed+` in Paris"}`)
+
+	for _, q := range []string{"name:" + composed, "name:" + decomposed, "description:" + composed, "description:" + decomposed} {
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.ElementsMatch(t, []string{a, b}, documentIds(res), q)
+		res = searchTestDocuments(t, s, url.Values{"q": {q}, "skipIndex": {"true"}})
+		assert.ElementsMatch(t, []string{a, b}, documentIds(res), q)
+	}
+}
+
+func Test_indexWriter(t *testing.T) {
+	s := newTestServer(t)
+	s.indexWriter = newIndexWriter(*s, time.Hour)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addTestDocument(t, s, `{"name": "Kevin"}`))
+	}
+	sort.Strings(ids)
+
+	// Nothing has been written within the window
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Nil(t, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "wait": {"true"}})
+	assert.Equal(t, ids, documentIds(res))
+
+	// Updates to the same document are applied in order
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/docs/"+ids[0], strings.NewReader(`{"name": "Bob"}`))
+	s.patchDocument(w, r, httprouter.Params{{Key: "id", Value: ids[0]}})
+	s.indexWriter.flush()
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Equal(t, ids[1:], documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Bob"}})
+	assert.Equal(t, ids[:1], documentIds(res))
+
+	// A deleted document is skipped while its unindex is queued
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/"+ids[1], nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, ids[2:], documentIds(res))
+}
+
+func Test_query_match_between(t *testing.T) {
+	q, err := parseQuery("age:between(18, 65)")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{
+		{key: []string{"age"}, value: "18", op: ">="},
+		{key: []string{"age"}, value: "65", op: "<="},
+	}, q.ands)
+
+	tests := []struct {
+		age           any
+		expectedMatch bool
+	}{
+		{30.0, true},
+		{18.0, true},
+		{65.0, true},
+		{17.9, false},
+		{66.0, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedMatch, q.match("", map[string]any{"age": test.age}), test.age)
+	}
+
+	q, err = parseQuery(`created:between(2024-01-01, "2024-01-31T23:59:59Z")`)
+	assert.Nil(t, err)
+	assert.True(t, q.match("", map[string]any{"created": "2024-01-31T23:59:59Z"}))
+	assert.False(t, q.match("", map[string]any{"created": "2024-02-01T00:00:00Z"}))
+
+	for _, bad := range []string{"age:between(18)", "age:between(18,65", "age:between(18 65)"} {
+		_, err = parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func Test_concurrencyLimiter(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := newConcurrencyLimiter(2, 0).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	<-started
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "overloaded", decodeTestResponse(t, w).Code)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []int{200, 200}, codes)
+
+	// Slots are given back
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_searchDocuments_wildcard(t *testing.T) {
+	s := newTestServer(t)
+	home := addTestDocument(t, s, `{"name": "Kevin", "address": {"home": {"city": "Boston"}}}`)
+	work := addTestDocument(t, s, `{"name": "Bob", "address": {"work": "Boston"}}`)
+	name := addTestDocument(t, s, `{"name": "Boston", "address": {"home": {"city": "Denver"}}}`)
+	addTestDocument(t, s, `{"name": "Jill", "address": {"home": {"city": "x=Boston"}}}`)
+
+	tests := []struct {
+		q           string
+		expectedIds []string
+	}{
+		{"*:Boston", []string{home, work, name}},
+		{"address.*:Boston", []string{home, work}},
+		{"address.home.*:Boston", []string{home}},
+		{"address.*:Boston name:Bob", []string{work}},
+	}
+
+	for _, test := range tests {
+		for _, skipIndex := range []string{"false", "true"} {
+			res := searchTestDocuments(t, s, url.Values{"q": {test.q}, "skipIndex": {skipIndex}})
+			assert.ElementsMatch(t, test.expectedIds, documentIds(res), test.q)
+		}
+	}
+}
+
+func Test_mergePatch(t *testing.T) {
+	// From RFC 7386 Appendix A
+	tests := []struct {
+		target   string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		var target, patch, expected any
+		assert.Nil(t, json.Unmarshal([]byte(test.target), &target))
+		assert.Nil(t, json.Unmarshal([]byte(test.patch), &patch))
+		assert.Nil(t, json.Unmarshal([]byte(test.expected), &expected))
+		assert.Equal(t, expected, mergePatch(target, patch), test.patch)
+	}
+}
+
+func Test_patchDocument_mergePatch(t *testing.T) {
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston", "zip": "02101"}, "tags": ["a", "b"]}`)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/docs/"+id, strings.NewReader(`{"address": {"zip": null}, "name": null, "tags": ["c"]}`))
+	r.Header.Set("Content-Type", "application/merge-patch+json")
+	s.patchDocument(w, r, httprouter.Params{{Key: "id", Value: id}})
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+
+	document := res.Body["document"].(map[string]any)
+	assert.Equal(t, map[string]any{"city": "Boston"}, document["address"])
+	assert.Equal(t, []any{"c"}, document["tags"])
+	assert.NotContains(t, document, "name")
+	assert.Contains(t, document, "_created")
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Nil(t, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"address.zip:02101"}})
+	assert.Nil(t, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"address.city:Boston"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_addDocument_skipIndex(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	indexed := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/docs", strings.NewReader(`{"name": "Kevin", "plan": "pro"}`))
+	r.Header.Set("X-Skip-Index", "true")
+	router.ServeHTTP(w, r)
+	skipped := decodeTestResponse(t, w).Body["id"].(string)
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{indexed}, ids)
+
+	// Until the reindex searches scan
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.ElementsMatch(t, []string{indexed, skipped}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	// And so do distinct, facets and cardinality
+	values, err := s.distinct("plan")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"pro"}, values)
+	count, err := s.countDistinct("plan")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/facets?field=name", nil))
+	assert.Equal(t, map[string]any{"Kevin": 2.0}, decodeTestResponse(t, w).Body["facets"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/reindex", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	ids, err = s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{indexed, skipped}, ids)
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "explain": {"true"}})
+	assert.Equal(t, false, res.Body["explain"].(map[string]any)["fullScan"])
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.ElementsMatch(t, []string{indexed, skipped}, documentIds(res))
+}
+
+func Test_searchDocuments_csv(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Ada", "address": {"city": "London"}}`)
+	b := addTestDocument(t, s, `{"name": "Bob", "tags": ["x", "y"]}`)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs?format=csv&sort=name", nil)
+	s.routes().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+
+	header := records[0]
+	assert.Equal(t, []string{"id", "_created", "_updated", "address.city", "name", "tags"}, header)
+	assert.Equal(t, a, records[1][0])
+	assert.Equal(t, []string{"London", "Ada", ""}, records[1][3:])
+	assert.Equal(t, b, records[2][0])
+	assert.Equal(t, []string{"", "Bob", `["x","y"]`}, records[2][3:])
+}
+
+func Test_tokenAuth(t *testing.T) {
+	handler := newTokenAuth("secret", false).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		authorization string
+		status        int
+	}{
+		{"", 401},
+		{"Bearer wrong", 401},
+		{"secret", 401},
+		{"Bearer secret", 200},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/docs", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, test.status, w.Code, test.authorization)
+		if test.status == 401 {
+			assert.Equal(t, "unauthorized", decodeTestResponse(t, w).Code)
+		}
+	}
+
+	// Reads are allowed without the token when only mutations need it
+	handler = newTokenAuth("secret", true).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/docs", nil))
+	assert.Equal(t, 401, w.Code)
+}
+
+func Test_query_match_object(t *testing.T) {
+	q, err := parseQuery(`meta:{"b": [1, 2], "a": 1} name:Kevin`)
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{
+		{key: []string{"meta"}, value: `{"a":1,"b":[1,2]}`, op: "=", object: true},
+		{key: []string{"name"}, value: "Kevin", op: "="},
+	}, q.ands)
+
+	tests := []struct {
+		meta          any
+		expectedMatch bool
+	}{
+		{map[string]any{"a": 1.0, "b": []any{1.0, 2.0}}, true},
+		{map[string]any{"a": json.Number("1"), "b": []any{json.Number("1"), json.Number("2")}}, true},
+		{map[string]any{"a": 2.0, "b": []any{1.0, 2.0}}, false},
+		{map[string]any{"a": 1.0}, false},
+		{`{"a":1,"b":[1,2]}`, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedMatch, q.match("", map[string]any{"meta": test.meta, "name": "Kevin"}), test.meta)
+	}
+
+	_, err = parseQuery(`meta:{"a": 1`)
+	assert.NotNil(t, err)
+
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"meta": {"a": 1}}`)
+	addTestDocument(t, s, `{"meta": {"a": 2}}`)
+	res := searchTestDocuments(t, s, url.Values{"q": {`meta:{"a":1}`}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_getVersion(t *testing.T) {
+	s := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "", res.Body["version"])
+	assert.Equal(t, "", res.Body["commit"])
+	assert.True(t, strings.HasPrefix(res.Body["goVersion"].(string), "go"))
+}
+
+func Test_indexKey_escaping(t *testing.T) {
+	// Without escaping these would both be indexed as a=b=c
+	assert.Equal(t, `a\=b=c`, indexKey("a=b", "c"))
+	assert.Equal(t, `a=b\=c`, indexKey("a", "b=c"))
+	assert.Equal(t, `a\\=b`, indexKey(`a\`, "b"))
+	assert.Equal(t, "b=c", unescapeIndexKey(`b\=c`))
+
+	s := newTestServer(t)
+	value := addTestDocument(t, s, `{"a": "b=c"}`)
+	key := addTestDocument(t, s, `{"a=b": "c"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {`a:"b=c"`}})
+	assert.Equal(t, []string{value}, documentIds(res))
+	assert.Equal(t, 1.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {`"a=b":c`}})
+	assert.Equal(t, []string{key}, documentIds(res))
+	assert.Equal(t, 1.0, res.Body["scanned"])
+
+	values, err := s.distinct("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b=c"}, values)
+}
+
+func Test_query_match_lexical(t *testing.T) {
+	q, err := parseQuery(`version:~<"1.10"`)
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"version"}, value: "1.10", op: "<", lexical: true}}, q.ands)
+
+	tests := []struct {
+		query         string
+		version       any
+		expectedMatch bool
+	}{
+		// "10" sorts before "9" as a string but not as a number
+		{`version:<9`, "10", false},
+		{`version:~<9`, "10", true},
+		{`version:>9`, "10", true},
+		{`version:~>9`, "10", false},
+		{`version:~>=10`, "10", true},
+		{`version:between(1, 5)`, "10", false},
+		{`version:~between(1, 5)`, "10", true},
+		{`version:~>"1.10"`, "1.9", true},
+		// Only strings compare lexically
+		{`version:~>1`, 2.0, false},
+		{`name:>abc`, "bcd", false},
+		{`name:~>abc`, "bcd", true},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		assert.Nil(t, err, test.query)
+		doc := map[string]any{"version": test.version, "name": test.version}
+		assert.Equal(t, test.expectedMatch, q.match("", doc), test.query)
+	}
+
+	_, err = parseQuery("version:~1.10")
+	assert.NotNil(t, err)
+}
+
+func Test_options(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+
+	tests := []struct {
+		path          string
+		expectedAllow string
+	}{
+		{"/docs", "GET, HEAD, OPTIONS, PATCH, POST"},
+		// POST is routed by id to sit alongside POST /docs/:id/append
+		{"/docs/abc", "DELETE, GET, OPTIONS, PATCH, POST, PUT"},
+		{"/docs/abc/raw", "GET, OPTIONS"},
+		{"/docs/abc/append", "OPTIONS, POST"},
+		{"/docs/validate-query", "DELETE, GET, OPTIONS, PATCH, POST, PUT"},
+		{"/metrics", "GET, OPTIONS"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("OPTIONS", test.path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, test.path)
+		assert.Equal(t, test.expectedAllow, w.Header().Get("Allow"), test.path)
+
+		// Operations are the same minus OPTIONS itself
+		methods := []string{"OPTIONS"}
+		for _, operation := range decodeTestResponse(t, w).Body["operations"].([]any) {
+			methods = append(methods, operation.(map[string]any)["method"].(string))
+		}
+		sort.Strings(methods)
+		assert.Equal(t, test.expectedAllow, strings.Join(methods, ", "), test.path)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/docs", nil))
+	operations := decodeTestResponse(t, w).Body["operations"].([]any)
+	assert.Equal(t, map[string]any{"method": "POST", "parameters": []any{"unlessExists"}}, operations[3])
+
+	// Unknown paths are still not found
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/nothing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_getIndexEntry(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"status": "active"}`)
+	b := addTestDocument(t, s, `{"status": "active"}`)
+	addTestDocument(t, s, `{"status": "inactive"}`)
+
+	// Not served unless enabled
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/admin/index?pathValue=status=active", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	s.admin = true
+	router := s.routes()
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/index?pathValue=status=active", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "status=active", res.Body["key"])
+	assert.ElementsMatch(t, []any{a, b}, res.Body["ids"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/index?pathValue=status=missing", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []any{}, decodeTestResponse(t, w).Body["ids"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/index", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_deleteDocument(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/"+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"?includeDeleted=true", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/"+id, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_deleteDocument_soft(t *testing.T) {
+	s := newTestServer(t)
+	s.softDelete = true
+	router := s.routes()
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+	kept := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/"+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Hidden from GETs, searches and updates
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, q := range []string{"name:Kevin", "_id:" + id, ""} {
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.NotContains(t, documentIds(res), id, q)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/docs/"+id, strings.NewReader(`{"a": 1}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{kept}, ids)
+
+	// Unless asked for
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"?includeDeleted=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, decodeTestResponse(t, w).Body["document"].(map[string]any)["_deleted"])
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "includeDeleted": {"true"}})
+	assert.ElementsMatch(t, []string{id, kept}, documentIds(res))
+
+	// Reindexing doesn't bring it back
+	s.reindex()
+	ids, err = s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{kept}, ids)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/purge", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1.0, decodeTestResponse(t, w).Body["purged"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "includeDeleted": {"true"}})
+	assert.Equal(t, []string{kept}, documentIds(res))
+}
+
+func Test_getConsistency(t *testing.T) {
+	s := newTestServer(t)
+	s.admin = true
+	a := addTestDocument(t, s, `{"status": "active"}`)
+	b := addTestDocument(t, s, `{"status": "inactive"}`)
+	router := s.routes()
+
+	check := func() testResponse {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/consistency", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return decodeTestResponse(t, w)
+	}
+
+	res := check()
+	assert.Equal(t, true, res.Body["consistent"])
+	assert.Equal(t, []any{}, res.Body["missingIds"])
+
+	// Lose a's index entry and b's document
+	assert.Nil(t, s.indexDb.Delete([]byte("status=active"), pebble.Sync))
+	assert.Nil(t, s.db.Delete([]byte(b), pebble.Sync))
+
+	res = check()
+	assert.Equal(t, false, res.Body["consistent"])
+	assert.Equal(t, float64(1), res.Body["missing"])
+	assert.Equal(t, []any{a}, res.Body["missingIds"])
+	assert.Equal(t, []any{b}, res.Body["danglingIds"])
+	assert.Greater(t, res.Body["dangling"], float64(0))
+
+	// Rebuilding the index fixes both
+	_, err := s.checkIndex(true)
+	assert.Nil(t, err)
+	assert.Equal(t, true, check().Body["consistent"])
+}
+
+func Test_checkIndex(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+	s.close()
+
+	// Nothing to do after a clean shutdown
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	reindexed, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.False(t, reindexed)
+
+	// Lose the index entry then crash without marking a clean shutdown
+	assert.Nil(t, s.indexDb.Delete([]byte("name=Kevin"), pebble.Sync))
+	s.db.Close()
+	s.indexDb.Close()
+
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	reindexed, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+	s.close()
+
+	// Changing what is indexed rebuilds too
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	s.tokenizedFields = map[string]bool{"name": true}
+	reindexed, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+	s.close()
+}
+
+func Test_serve_shutdown(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	_, err = s.checkIndex(false)
+	assert.Nil(t, err)
+
+	// Updates stay queued until the writer is closed
+	s.indexWriter = newIndexWriter(*s, time.Hour)
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.serve(ctx, &http.Server{Addr: "127.0.0.1:0", Handler: s.routes()})
+	}()
+	cancel()
+	assert.Nil(t, <-done)
+
+	// Shutting down flushed the index and marked it clean
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.False(t, reindexed)
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+}
+
+func Test_close_unindexed(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	_, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	indexed := addTestDocument(t, s, `{"name": "Kevin"}`)
+	s.lazyIndex = true
+	lazy := addTestDocument(t, s, `{"name": "Kevin"}`)
+	s.close()
+
+	// The lazily inserted document wasn't indexed so the index isn't
+	// marked clean and gets rebuilt with it
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.ElementsMatch(t, []string{indexed, lazy}, documentIds(res))
+}
+
+func Test_checkIndex_documentCount(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	_, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+	s.close()
+
+	// The count matches so the index is used as is
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.False(t, reindexed)
+	s.close()
+
+	// Add a document behind the index's back, like copying in the
+	// documents without their index
+	db, err := pebble.Open(database, &pebble.Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte(uuid.New().String()), []byte(`{"name": "Sam"}`), pebble.Sync))
+	assert.Nil(t, db.Close())
+
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	reindexed, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Sam"}})
+	assert.Equal(t, 1.0, res.Body["count"])
+}
+
+func Test_reindexOnStart(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	_, err = s.checkIndex(false)
+	assert.Nil(t, err)
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+	addTestDocument(t, s, `{"name": "Sam"}`)
+	s.close()
+
+	// The index looks up to date after a clean shutdown
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.False(t, reindexed)
+	s.close()
+
+	// Forcing rebuilds it even so, e.g. after deleting it by hand
+	assert.Nil(t, os.RemoveAll(database+".index"))
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	reindexed, err = s.checkIndex(true)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+}
+
+func Test_parseQuery_defaultField(t *testing.T) {
+	// Still an error without a default
+	_, err := parseQuery("foo")
+	assert.NotNil(t, err)
+
+	q, err := parseQueryWithDefault(`foo "bar baz" age:3 (qux OR n.x:1)`, []string{"name"})
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{
+		{key: []string{"name"}, value: "foo", op: "="},
+		{key: []string{"name"}, value: "bar baz", op: "="},
+		{key: []string{"age"}, value: "3", op: "="},
+	}, q.ands)
+	assert.Equal(t, [][]query{{
+		{ands: []queryComparison{{key: []string{"name"}, value: "qux", op: "="}}},
+		{ands: []queryComparison{{key: []string{"n", "x"}, value: "1", op: "="}}},
+	}}, q.ors)
+
+	s := newTestServer(t)
+	s.defaultField = "profile.name"
+	kevin := addTestDocument(t, s, `{"profile": {"name": "Kevin"}, "age": 45}`)
+	addTestDocument(t, s, `{"profile": {"name": "Sam"}, "age": 45, "name": "Kevin"}`)
+
+	for _, query := range []string{"Kevin", "Kevin age:45", "profile.name:Kevin"} {
+		res := searchTestDocuments(t, s, url.Values{"q": {query}})
+		assert.Equal(t, []string{kevin}, documentIds(res), query)
+	}
+}
+
+func Test_query_near(t *testing.T) {
+	assert.InDelta(t, 306, haversineKm(42.3601, -71.0589, 40.7128, -74.0060), 1)
+
+	for _, bad := range []string{"l:near(1,2)", "l:near(a,2,3)", "l:near(1,2,-3)"} {
+		_, err := parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	s := newTestServer(t)
+	boston := addTestDocument(t, s, `{"location": {"lat": 42.3601, "lng": -71.0589}}`)
+	cambridge := addTestDocument(t, s, `{"location": {"lat": 42.3736, "lng": -71.1097}}`)
+	nyc := addTestDocument(t, s, `{"location": {"lat": 40.7128, "lng": -74.0060}}`)
+	addTestDocument(t, s, `{"location": "Boston"}`)
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+	both := addTestDocument(t, s, `{"location": [{"lat": 0, "lng": 0}, {"lat": 40.7, "lng": -74}]}`)
+
+	tests := []struct {
+		query       string
+		expectedIds []string
+	}{
+		{"location:near(42.36,-71.06,10)", []string{boston, cambridge}},
+		{"location:near(42.36,-71.06,1)", []string{boston}},
+		{"location:near(42.36,-71.06,500)", []string{boston, cambridge, nyc, both}},
+		{"location:near(0,0,0)", []string{both}},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}})
+		assert.ElementsMatch(t, test.expectedIds, documentIds(res), test.query)
+	}
+}
+
+func Test_query_now(t *testing.T) {
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]string{
+		"now":       "2022-04-01T12:00:00Z",
+		"now-1h":    "2022-04-01T11:00:00Z",
+		"now+1h30m": "2022-04-01T13:30:00Z",
+		"now-7d":    "2022-03-25T12:00:00Z",
+		"now+1d":    "2022-04-02T12:00:00Z",
+	} {
+		at, err := resolveNow(value, now)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, at, value)
+	}
+
+	for _, bad := range []string{"expires:<now-1x", "expires:>now+"} {
+		_, err := parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	// Only unquoted range values are relative
+	q, err := parseQuery(`expires:now status:<"now"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "now", q.ands[0].value)
+	assert.Equal(t, "now", q.ands[1].value)
+
+	s := newTestServer(t)
+	at := func(offset time.Duration) string {
+		return time.Now().Add(offset).UTC().Format(time.RFC3339)
+	}
+	expired := addTestDocument(t, s, fmt.Sprintf(`{"expires": %q}`, at(-2*time.Hour)))
+	recent := addTestDocument(t, s, fmt.Sprintf(`{"expires": %q}`, at(-30*time.Minute)))
+	future := addTestDocument(t, s, fmt.Sprintf(`{"expires": %q}`, at(time.Hour)))
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"expires:<now"}})
+	assert.ElementsMatch(t, []string{expired, recent}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"expires:>now-1h"}})
+	assert.ElementsMatch(t, []string{recent, future}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"_created:>now-1h"}})
+	assert.Equal(t, 3.0, res.Body["count"])
+
+	// between resolves now in either bound
+	res = searchTestDocuments(t, s, url.Values{"q": {"expires:between(now-1h,now+2h)"}})
+	assert.ElementsMatch(t, []string{recent, future}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"_created:between(now-1d,now)"}})
+	assert.Equal(t, 3.0, res.Body["count"])
+
+	q, err = parseQuery(`expires:between("now",now)`)
+	assert.Nil(t, err)
+	assert.Equal(t, "now", q.ands[0].value)
+	assert.False(t, q.ands[0].relative)
+	assert.True(t, q.ands[1].relative)
+
+	_, err = parseQuery("expires:between(now-1x,now)")
+	assert.NotNil(t, err)
+}
+
+func Test_query_typedLiterals(t *testing.T) {
+	q, err := parseQuery("qty:int(3)")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"qty"}, value: "3", op: "=", literal: "int"}}, q.ands)
+
+	for _, bad := range []string{"qty:int(3.5)", "qty:float(x)", "active:bool(yes)", "active:>bool(true)", "qty:int(1,2)", "qty:~>int(3)"} {
+		_, err := parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	tests := []struct {
+		query         string
+		value         any
+		expectedMatch bool
+	}{
+		{"qty:int(3)", 3.0, true},
+		{"qty:int(3)", "3", false},
+		{"qty:int(3)", 3.5, false},
+		{"qty:>int(2)", 3.0, true},
+		{"qty:>int(2)", "3", false},
+		{"qty:float(3.5)", 3.5, true},
+		{"qty:float(3)", 3.0, true},
+		{"qty:float(3.5)", "3.5", false},
+		{"qty:float(3.5)", json.Number("3.50"), true},
+		{"active:bool(true)", true, true},
+		{"active:bool(true)", "true", false},
+		{"active:bool(false)", true, false},
+		{"name:string(3)", "3", true},
+		{"name:string(3)", 3.0, false},
+		{"name:string(true)", true, false},
+		{"tags:string(go)", []any{1.0, "go"}, true},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		assert.Nil(t, err, test.query)
+
+		doc := map[string]any{}
+		doc[q.ands[0].key[0]] = test.value
+		assert.Equal(t, test.expectedMatch, q.match("id", doc), fmt.Sprintf("%s against %#v", test.query, test.value))
+	}
+
+	// The index holds 3 and "3" under the same key
+	s := newTestServer(t)
+	number := addTestDocument(t, s, `{"qty": 3, "active": true}`)
+	str := addTestDocument(t, s, `{"qty": "3", "active": "true"}`)
+	for query, expected := range map[string]string{
+		"qty:int(3)":          number,
+		"qty:string(3)":       str,
+		"active:bool(true)":   number,
+		"active:string(true)": str,
+	} {
+		res := searchTestDocuments(t, s, url.Values{"q": {query}})
+		assert.Equal(t, []string{expected}, documentIds(res), query)
+	}
+}
+
+func Test_query_match_arrays(t *testing.T) {
+	q, err := parseQuery("tags:all(go)")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"tags"}, value: "go", op: "=", all: true}}, q.ands)
+
+	tests := []struct {
+		query         string
+		tags          any
+		expectedMatch bool
+	}{
+		{"tags:go", []any{"go", "rust"}, true},
+		{"tags:any(go)", []any{"go", "rust"}, true},
+		{"tags:all(go)", []any{"go", "rust"}, false},
+		{"tags:all(go)", []any{"go", "go"}, true},
+		{"tags:all(go)", []any{}, false},
+		{"tags:any(go)", []any{}, false},
+		{"tags:all(go)", "go", true},
+		{"tags:c", []any{"go", "rust"}, false},
+		{"tags:>2", []any{1.0, 3.0}, true},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		assert.Nil(t, err, test.query)
+		assert.Equal(t, test.expectedMatch, q.match("", map[string]any{"tags": test.tags}), test.query)
+	}
+
+	for _, bad := range []string{"tags:all(a, b)", "*:all(go)", "tags:any()", "tags:all(>2)"} {
+		_, err = parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	s := newTestServer(t)
+	both := addTestDocument(t, s, `{"tags": ["go", "rust"]}`)
+	only := addTestDocument(t, s, `{"tags": ["go"]}`)
+	addTestDocument(t, s, `{"tags": ["rust"]}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"tags:go"}})
+	assert.ElementsMatch(t, []string{both, only}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"tags:all(go)"}})
+	assert.Equal(t, []string{only}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+}
+
+func Test_getRawDocument(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	id := addTestDocument(t, s, `{"b": 1.50, "a": {"z": 1, "y": 2}}`)
+
+	stored, closer, err := s.db.Get([]byte(id))
+	assert.Nil(t, err)
+	defer closer.Close()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"/raw", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, stored, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/missing/raw", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "not_found", decodeTestResponse(t, w).Code)
+}
+
+func indexTestKeys(t *testing.T, s *server) []string {
+	iter := s.indexDb.NewIter(nil)
+	defer iter.Close()
+
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		// Skip metadata
+		if !strings.HasPrefix(string(iter.Key()), "\x00meta\x00") {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	assert.Nil(t, iter.Error())
+	return keys
+}
+
+func Test_indexInclude(t *testing.T) {
+	s := newTestServer(t)
+	s.indexInclude = map[string]bool{"name": true, "address": true}
+	id := addTestDocument(t, s, `{"name": "Kevin", "age": 45, "address": {"city": "Boston"}}`)
+
+	assert.ElementsMatch(t, []string{"name=Kevin", "address.city=Boston"}, indexTestKeys(t, s))
+
+	// Fields that aren't indexed are still found by scanning
+	for _, q := range []string{"name:Kevin", "address.city:Boston", "age:45", "*:45"} {
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.Equal(t, []string{id}, documentIds(res), q)
+	}
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"age:45"}, "explain": {"true"}})
+	assert.Equal(t, true, res.Body["explain"].(map[string]any)["fullScan"])
+}
+
+func Test_indexExclude(t *testing.T) {
+	s := newTestServer(t)
+	s.indexExclude = map[string]bool{"address": true, "_created": true, "_updated": true}
+	id := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston"}}`)
+
+	assert.Equal(t, []string{"name=Kevin"}, indexTestKeys(t, s))
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"address.city:Boston"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_encodePostings(t *testing.T) {
+	ids := []string{uuid.New().String(), uuid.New().String()}
+
+	binary := encodePostings(ids, true)
+	assert.Equal(t, 1+16*len(ids), len(binary))
+	assert.Equal(t, ids, decodePostings(binary))
+
+	text := encodePostings(ids, false)
+	assert.Equal(t, strings.Join(ids, ","), string(text))
+	assert.Equal(t, ids, decodePostings(text))
+
+	// Ids that aren't uuids stay text
+	other := []string{ids[0], "12"}
+	assert.Equal(t, "12", string(encodePostings(other, true)[len(ids[0])+1:]))
+	assert.Equal(t, other, decodePostings(encodePostings(other, true)))
+
+	assert.Nil(t, decodePostings(nil))
+
+	// Text postings written before switching are still read and are
+	// converted when next updated
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin"}`)
+	s.binaryPostings = true
+	r := httptest.NewRequest("POST", "/docs", strings.NewReader(`{"name": "Kevin"}`))
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	b := decodeTestResponse(t, w).Body["id"].(string)
+
+	stored, closer, err := s.indexDb.Get([]byte("name=Kevin"))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(binaryPostingsFormat), stored[0])
+	closer.Close()
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.ElementsMatch(t, []string{a, b}, documentIds(res))
+}
+
+func Test_query_match_pipeList(t *testing.T) {
+	q, err := parseQuery(`status:active|pending|"on trial"`)
+	assert.Nil(t, err)
+	assert.Equal(t, query{ors: [][]query{{
+		{ands: []queryComparison{{key: []string{"status"}, value: "active", op: "="}}},
+		{ands: []queryComparison{{key: []string{"status"}, value: "pending", op: "="}}},
+		{ands: []queryComparison{{key: []string{"status"}, value: "on trial", op: "="}}},
+	}}}, *q)
+
+	for status, expectedMatch := range map[string]bool{"active": true, "pending": true, "on trial": true, "cancelled": false, "trial": false} {
+		assert.Equal(t, expectedMatch, q.match("", map[string]any{"status": status}), status)
+	}
+
+	for _, bad := range []string{"status:active|", "status:|active", "status:>1|2"} {
+		_, err = parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	s := newTestServer(t)
+	active := addTestDocument(t, s, `{"status": "active", "plan": "pro"}`)
+	pending := addTestDocument(t, s, `{"status": "pending", "plan": "pro"}`)
+	addTestDocument(t, s, `{"status": "cancelled", "plan": "pro"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"plan:pro status:active|pending"}})
+	assert.ElementsMatch(t, []string{active, pending}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+}
+
+func Test_query_match_regexp(t *testing.T) {
+	q, err := parseQuery(`name:/^jo.*n$/ path:/a\/b/`)
+	assert.Nil(t, err)
+	assert.Equal(t, "^jo.*n$", q.ands[0].value)
+	assert.Equal(t, "a/b", q.ands[1].value)
+
+	tests := []struct {
+		name          any
+		expectedMatch bool
+	}{
+		{"john", true},
+		{"jon", true},
+		{"joan", true},
+		{"Jon", false},
+		{"johnny", false},
+		{[]any{"bob", "john"}, true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedMatch, q.match("", map[string]any{"name": test.name, "path": "/a/b/"}), test.name)
+	}
+
+	for _, bad := range []string{"name:/(/", "name:/abc", "name:/" + strings.Repeat("a", maxRegexpLength+1) + "/"} {
+		_, err = parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	assert.Equal(t, "jo", regexpPrefix("^jo.*n$"))
+	assert.Equal(t, "", regexpPrefix("jo.*n$"))
+	assert.Equal(t, "", regexpPrefix("^(?i)jo"))
+	assert.Equal(t, "", regexpPrefix("^a|^b"))
+
+	s := newTestServer(t)
+	john := addTestDocument(t, s, `{"name": "john"}`)
+	addTestDocument(t, s, `{"name": "johnny"}`)
+	addTestDocument(t, s, `{"name": "bob"}`)
+	addTestDocument(t, s, `{"name": "ajon"}`)
+
+	// Only values with the literal prefix are read
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:/^jo.*n$/"}})
+	assert.Equal(t, []string{john}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:/jo.*n$/"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	assert.Equal(t, 4.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:/(/"}})
+	assert.Equal(t, "invalid_query", res.Code)
+}
+
+func Test_searchDocuments_limit(t *testing.T) {
+	s := newTestServer(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addTestDocument(t, s, fmt.Sprintf(`{"name": "Kevin", "i": %d}`, i)))
+	}
+	addTestDocument(t, s, `{"name": "Bob"}`)
+	sort.Strings(ids)
+
+	ids2, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, ids, ids2)
+
+	for _, skipIndex := range []string{"false", "true"} {
+		res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "limit": {"2"}, "skipIndex": {skipIndex}})
+		assert.Equal(t, ids[:2], documentIds(res))
+
+		res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "limit": {"2"}, "order": {"desc"}, "skipIndex": {skipIndex}})
+		assert.Equal(t, []string{ids[4], ids[3]}, documentIds(res))
+		if skipIndex == "false" {
+			// Only the last two candidates are read
+			assert.Equal(t, 2.0, res.Body["scanned"])
+		}
+
+		res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "order": {"desc"}, "skipIndex": {skipIndex}})
+		assert.Equal(t, []string{ids[4], ids[3], ids[2], ids[1], ids[0]}, documentIds(res))
+	}
+
+	// Limits apply after sorting
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "limit": {"2"}, "sort": {"-i"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	assert.Equal(t, 4.0, res.Body["documents"].([]any)[0].(map[string]any)["body"].(map[string]any)["i"])
+
+	for _, bad := range []url.Values{{"limit": {"x"}}, {"limit": {"-1"}}, {"order": {"up"}}} {
+		res = searchTestDocuments(t, s, bad)
+		assert.Equal(t, "error", res.Status, bad)
+	}
+}
+
+func benchmarkLastTen(b *testing.B, limit int) {
+	s, err := newServer(b.TempDir()+"/docdb.data", "8080")
+	assert.Nil(b, err)
+	defer s.close()
+
+	batch := s.db.NewBatch()
+	for i := 0; i < 10000; i++ {
+		err = batch.Set([]byte(uuid.New().String()), []byte(fmt.Sprintf(`{"name": "Kevin", "i": %d}`, i)), nil)
+		assert.Nil(b, err)
+	}
+	assert.Nil(b, batch.Commit(pebble.Sync))
+	s.reindex()
+
+	q, err := s.parseQuery("name:Kevin")
+	assert.Nil(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan, err := s.planQuery(q, false)
+		assert.Nil(b, err)
+		plan.limit = limit
+		plan.descending = true
+
+		results, _, err := s.search(q, plan)
+		assert.Nil(b, err)
+		if limit == 0 {
+			// What getting the last ten took without a limit
+			sortResults(results, nil)
+			results = results[len(results)-10:]
+		}
+		assert.Equal(b, 10, len(results))
+	}
+}
+
+func BenchmarkSearch_lastTen(b *testing.B) {
+	b.Run("all", func(b *testing.B) { benchmarkLastTen(b, 0) })
+	b.Run("limit", func(b *testing.B) { benchmarkLastTen(b, 10) })
+}
+
+func Test_maxCardinality(t *testing.T) {
+	database := t.TempDir() + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	s.maxCardinality = 3
+
+	for i := 0; i < 5; i++ {
+		addTestDocument(t, s, fmt.Sprintf(`{"ref": "r%d", "status": "active"}`, i))
+	}
+
+	// Counting stops once the field stops being indexed
+	assert.Equal(t, int64(4), s.cardinality.get("ref"))
+	assert.Equal(t, int64(1), s.cardinality.get("status"))
+
+	// Values past the threshold aren't indexed and ref queries scan
+	ids, err := s.lookup("ref=r4")
+	assert.Nil(t, err)
+	assert.Nil(t, ids)
+	ids, err = s.lookup("status=active")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(ids))
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"ref:r4"}})
+	assert.Equal(t, 1.0, res.Body["count"])
+	assert.Equal(t, 5.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"status:active"}, "explain": {"true"}})
+	assert.Equal(t, false, res.Body["explain"].(map[string]any)["fullScan"])
+
+	// Postings indexed before the field was capped are dropped rather
+	// than going stale as documents change
+	ids, err = s.lookup("ref=r0")
+	assert.Nil(t, err)
+	assert.Nil(t, ids)
+	res = searchTestDocuments(t, s, url.Values{"q": {"ref:r0"}})
+	first := documentIds(res)[0]
+	document, err := s.getDocumentById([]byte(first))
+	assert.Nil(t, err)
+	document["ref"] = "r9"
+	bs, err := json.Marshal(document)
+	assert.Nil(t, err)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("PUT", "/docs/"+first, strings.NewReader(string(bs))))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"ref:r0"}})
+	assert.Nil(t, documentIds(res))
+	values, err := s.distinct("ref")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"r1", "r2", "r3", "r4", "r9"}, values)
+	count, err := s.countDistinct("ref")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+
+	// The counts survive restarts
+	s.close()
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	s.maxCardinality = 3
+	assert.Equal(t, int64(4), s.cardinality.get("ref"))
+	assert.False(t, s.isIndexed("ref"))
+	assert.True(t, s.isIndexed("status"))
+}
+
+func Test_lookup_longKey(t *testing.T) {
+	s := newTestServer(t)
+
+	// Index keys are Pebble keys rather than file names so they have
+	// no length limit to hash around
+	long := strings.Repeat("v", 1000)
+	path := strings.Repeat("nested.", 50) + "key"
+	document := map[string]any{}
+	obj := document
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child := map[string]any{}
+		obj[part] = child
+		obj = child
+	}
+	obj[parts[len(parts)-1]] = long
+	bs, err := json.Marshal(document)
+	assert.Nil(t, err)
+	id := addTestDocument(t, s, string(bs))
+
+	key := indexKey(path, long)
+	assert.Greater(t, len(key), 1000)
+	ids, err := s.lookup(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {path + ":" + long}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_maxIndexedLength(t *testing.T) {
+	s := newTestServer(t)
+	s.maxIndexedLength = 64
+	long := strings.Repeat("word ", 20)
+	a := addTestDocument(t, s, fmt.Sprintf(`{"title": "short", "body": %q}`, long))
+	b := addTestDocument(t, s, `{"title": "other", "body": "brief"}`)
+
+	document, err := s.getDocumentById([]byte(a))
+	assert.Nil(t, err)
+	assert.Equal(t, long, document["body"])
+	keys := s.indexKeys(document)
+	assert.Contains(t, keys, "_created="+document["_created"].(string))
+	for _, key := range keys {
+		assert.Less(t, len(key), len(long), key)
+	}
+
+	tests := []struct {
+		query       string
+		expectedIds []string
+		fullScan    bool
+	}{
+		{"title:short", []string{a}, false},
+		{"body:brief", []string{b}, false},
+		{fmt.Sprintf("body:%q", long), []string{a}, true},
+		{"body:/^word/", []string{a}, true},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}})
+		assert.Equal(t, test.expectedIds, documentIds(res), test.query)
+
+		res = searchTestDocuments(t, s, url.Values{"q": {test.query}, "explain": {"true"}})
+		assert.Equal(t, test.fullScan, res.Body["explain"].(map[string]any)["fullScan"], test.query)
+	}
+
+	// Long values aren't in the index but are still counted
+	values, err := s.distinct("body")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"brief", long}, values)
+	count, err := s.countDistinct("body")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/facets?field=body", nil))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, map[string]any{"brief": 1.0, long: 1.0}, res.Body["facets"])
+}
+
+func Test_facetValues(t *testing.T) {
+	s := newTestServer(t)
+	addTestDocument(t, s, `{"plan": "pro", "status": "active", "tags": ["a", "b"]}`)
+	addTestDocument(t, s, `{"plan": "pro", "status": "active", "tags": ["a"]}`)
+	addTestDocument(t, s, `{"plan": "pro", "status": "pending"}`)
+	addTestDocument(t, s, `{"plan": "free", "status": "active"}`)
+
+	facets := func(v url.Values) map[string]any {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/facets?"+v.Encode(), nil))
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, http.StatusOK, w.Code, res.Error)
+		return res.Body["facets"].(map[string]any)
+	}
+
+	assert.Equal(t, map[string]any{"active": 2.0, "pending": 1.0}, facets(url.Values{"field": {"status"}, "q": {"plan:pro"}}))
+	assert.Equal(t, map[string]any{"active": 3.0, "pending": 1.0}, facets(url.Values{"field": {"status"}}))
+	assert.Equal(t, map[string]any{"a": 2.0, "b": 1.0}, facets(url.Values{"field": {"tags"}, "q": {"plan:pro"}}))
+
+	// Fields that aren't indexed are counted from the documents
+	s.indexExclude = map[string]bool{"status": true, "tags": true}
+	assert.Equal(t, map[string]any{"active": 2.0, "pending": 1.0}, facets(url.Values{"field": {"status"}, "q": {"plan:pro"}}))
+	assert.Equal(t, map[string]any{"a": 2.0, "b": 1.0}, facets(url.Values{"field": {"tags"}, "q": {"plan:pro"}}))
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/facets", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_columnValues(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin", "plan": "pro", "address": {"city": "Boston"}}`)
+	b := addTestDocument(t, s, `{"name": "Alice", "plan": "pro"}`)
+	addTestDocument(t, s, `{"name": "Bob", "plan": "free", "address": {"city": "Paris"}}`)
+	rows := [][]any{{a, "Kevin", "Boston"}, {b, "Alice", nil}}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0].(string) < rows[j][0].(string) })
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/columns?"+url.Values{"fields": {"name,address.city"}, "q": {"plan:pro"}}.Encode(), nil))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, http.StatusOK, w.Code, res.Error)
+	assert.Equal(t, []any{"name", "address.city"}, res.Body["fields"])
+
+	var expected []any
+	for _, row := range rows {
+		expected = append(expected, row)
+	}
+	assert.Equal(t, expected, res.Body["rows"])
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/columns?q=plan:pro", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Redacted fields are left out of the objects holding them
+	s.redactions = parseFields("address.city")
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/columns?"+url.Values{"fields": {"address"}, "q": {"name:Kevin"}}.Encode(), nil))
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, http.StatusOK, w.Code, res.Error)
+	assert.Equal(t, []any{[]any{a, map[string]any{}}}, res.Body["rows"])
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/columns?fields=address.city", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_getDocument_sortedKeys(t *testing.T) {
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"b": 1, "a": {"z": 1, "y": [{"d": 1, "c": 2}]}, "_x": true}`)
+
+	// encoding/json writes map keys sorted so responses are
+	// deterministic however the document was written
+	var bodies []string
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id, nil))
+		bodies = append(bodies, w.Body.String())
+	}
+
+	for _, body := range bodies {
+		assert.Equal(t, bodies[0], body)
+	}
+
+	document := bodies[0][strings.Index(bodies[0], `{"_created"`):]
+	assert.True(t, strings.HasPrefix(document, `{"_created":`))
+	assert.Contains(t, document, `"_x":true,"a":{"y":[{"c":2,"d":1}],"z":1},"b":1}`)
+}
+
+func Test_query_match_exists(t *testing.T) {
+	q, err := parseQuery("address:*")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"address"}, value: "*", op: "=", exists: true}}, q.ands)
+
+	tests := []struct {
+		doc           map[string]any
+		expectedMatch bool
+	}{
+		{map[string]any{"address": map[string]any{"city": "Boston"}}, true},
+		{map[string]any{"address": map[string]any{"geo": map[string]any{"lat": 1.0}}}, true},
+		{map[string]any{"address": "Boston"}, true},
+		{map[string]any{"address": []any{"a"}}, true},
+		{map[string]any{"address": map[string]any{}}, false},
+		{map[string]any{"name": "Kevin"}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedMatch, q.match("", test.doc), test.doc)
+	}
+
+	// A quoted * is just a value
+	q, err = parseQuery(`address:"*"`)
+	assert.Nil(t, err)
+	assert.False(t, q.ands[0].exists)
+
+	_, err = parseQuery("*:*")
+	assert.NotNil(t, err)
+
+	s := newTestServer(t)
+	city := addTestDocument(t, s, `{"address": {"city": "Boston"}}`)
+	geo := addTestDocument(t, s, `{"address": {"geo": {"lat": 1}}}`)
+	addTestDocument(t, s, `{"addresses": {"city": "Boston"}}`)
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"address:*"}})
+	assert.ElementsMatch(t, []string{city, geo}, documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"address:*"}, "skipIndex": {"true"}})
+	assert.ElementsMatch(t, []string{city, geo}, documentIds(res))
+}
+
+func Test_replayWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	database := dir + "/docdb.data"
+	s, err := newServer(database, "8080")
+	assert.Nil(t, err)
+	s.wal, err = openWriteAheadLog(dir+"/docdb.data.wal", 0)
+	assert.Nil(t, err)
+
+	applied := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	// Crash after logging writes but before applying them
+	logged := uuid.New().String()
+	err = s.wal.write([]walEntry{
+		{Op: walSet, Id: logged, Document: json.RawMessage(`{"name": "Kevin"}`)},
+		{Op: walDelete, Id: applied},
+	}, func() error { return nil })
+	assert.Nil(t, err)
+	_, err = s.wal.file.WriteString(`{"op": "set", "id": "torn`)
+	assert.Nil(t, err)
+	s.wal.close()
+	s.db.Close()
+	s.indexDb.Close()
+
+	s, err = newServer(database, "8080")
+	assert.Nil(t, err)
+	t.Cleanup(s.close)
+	s.wal, err = openWriteAheadLog(dir+"/docdb.data.wal", 0)
+	assert.Nil(t, err)
+
+	// The applied insert is replayed again too
+	replayed, err := s.replayWriteAheadLog()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, replayed)
+
+	entries, err := s.wal.read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	reindexed, err := s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, reindexed)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Equal(t, []string{logged}, documentIds(res))
+	_, err = s.getDocumentById([]byte(applied))
+	assert.NotNil(t, err)
+}
+
+func Test_writeAheadLog_checkpoint(t *testing.T) {
+	l, err := openWriteAheadLog(t.TempDir()+"/wal", 2)
+	assert.Nil(t, err)
+	defer l.close()
+
+	apply := func() error { return nil }
+	assert.Nil(t, l.write([]walEntry{{Op: walDelete, Id: "1"}}, apply))
+	entries, err := l.read()
+	assert.Nil(t, err)
+	assert.Equal(t, []walEntry{{Op: walDelete, Id: "1"}}, entries)
+
+	assert.Nil(t, l.write([]walEntry{{Op: walDelete, Id: "2"}}, apply))
+	entries, err = l.read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// Entries that fail to apply don't count towards a checkpoint and
+	// are dropped so they aren't replayed
+	assert.Nil(t, l.write([]walEntry{{Op: walDelete, Id: "3"}}, apply))
+	assert.NotNil(t, l.write([]walEntry{{Op: walDelete, Id: "4"}}, func() error { return fmt.Errorf("oops") }))
+	assert.Equal(t, 1, l.entries)
+	entries, err = l.read()
+	assert.Nil(t, err)
+	assert.Equal(t, []walEntry{{Op: walDelete, Id: "3"}}, entries)
+}
+
+func Test_replayWriteAheadLog_badEntry(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newServer(dir+"/docdb.data", "8080")
+	assert.Nil(t, err)
+	t.Cleanup(s.close)
+	s.wal, err = openWriteAheadLog(dir+"/docdb.data.wal", 0)
+	assert.Nil(t, err)
+
+	id := uuid.New().String()
+	err = s.wal.write([]walEntry{{Op: "rename", Id: "1"}, {Op: walSet, Id: id, Document: json.RawMessage(`{"name": "Kevin"}`)}}, func() error { return nil })
+	assert.Nil(t, err)
+
+	// The bad entry is skipped and not replayed again
+	replayed, err := s.replayWriteAheadLog()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	_, err = s.getDocumentById([]byte(id))
+	assert.Nil(t, err)
+
+	entries, err := s.wal.read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_searchDocuments_head(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+	addTestDocument(t, s, `{"name": "Kevin"}`)
+	addTestDocument(t, s, `{"name": "Bob"}`)
+
+	for _, q := range []string{"name:Kevin", "name:Bob", "name:Nobody", ""} {
+		res := searchTestDocuments(t, s, url.Values{"q": {q}})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("HEAD", "/docs?"+url.Values{"q": {q}}.Encode(), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprintf("%v", res.Body["count"]), w.Header().Get("X-Total-Count"), q)
+		assert.Equal(t, 0, w.Body.Len())
+	}
+}
+
+func Test_uuidV7Generator(t *testing.T) {
+	g := &uuidV7Generator{}
+	now := time.Now()
+
+	var ids []string
+	for i := 0; i < 5000; i++ {
+		// Many ids in the same millisecond, and the clock going back
+		at := now
+		if i == 4000 {
+			at = now.Add(-time.Second)
+		}
+
+		id, err := g.new(at)
+		assert.Nil(t, err)
+		assert.Equal(t, uuid.Version(7), id.Version())
+		assert.Equal(t, uuid.RFC4122, id.Variant())
+		ids = append(ids, id.String())
+	}
+	assert.True(t, sort.StringsAreSorted(ids))
+
+	s := newTestServer(t)
+	s.uuidV7 = g
+	var inserted []string
+	for i := 0; i < 10; i++ {
+		inserted = append(inserted, addTestDocument(t, s, `{"name": "Kevin"}`))
+	}
+	assert.True(t, sort.StringsAreSorted(inserted))
+
+	// The most recent documents come first by id
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "order": {"desc"}, "limit": {"3"}})
+	assert.Equal(t, []string{inserted[9], inserted[8], inserted[7]}, documentIds(res))
+}
+
+func Test_addDocument_maxDepth(t *testing.T) {
+	assert.Equal(t, 0, depth("a"))
+	assert.Equal(t, 1, depth(map[string]any{"a": 1.0}))
+	assert.Equal(t, 3, depth(map[string]any{"a": []any{map[string]any{}}, "b": 1.0}))
+
+	s := newTestServer(t)
+	s.maxDepth = 3
+	router := s.routes()
+
+	addTestDocument(t, s, `{"a": {"b": {"c": 1}}}`)
+
+	for _, body := range []string{`{"a": {"b": {"c": {"d": 1}}}}`, `{"a": [[[1]]]}`, `{"a": {"b": [{"c": 1}]}}`} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/docs", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "invalid_document", res.Code)
+		assert.Equal(t, "Document is nested more than 3 levels deep", res.Error)
+	}
+
+	res := searchTestDocuments(t, s, url.Values{})
+	assert.Equal(t, 1.0, res.Body["count"])
+}
+
+func Test_addDocument_maxDocumentSize(t *testing.T) {
+	s := newTestServer(t)
+	s.maxDocumentSize = 200
+	router := s.routes()
+
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+	stored, closer, err := s.db.Get([]byte(id))
+	assert.Nil(t, err)
+	size := len(stored)
+	closer.Close()
+
+	body := fmt.Sprintf(`{"name": "Big", "bio": %q}`, strings.Repeat("a", 200))
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/docs", strings.NewReader(body)),
+		httptest.NewRequest("PUT", "/docs/"+id, strings.NewReader(body)),
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "invalid_document", res.Code)
+		assert.Contains(t, res.Error, "more than the maximum of 200")
+	}
+
+	// Neither stored nor indexed
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Big"}})
+	assert.Equal(t, 0.0, res.Body["count"])
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), fmt.Sprintf("\ndocdb_largest_document_bytes %d\n", size))
+}
+
+func Test_searchDocuments_mapShape(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin", "i": 1}`)
+	b := addTestDocument(t, s, `{"name": "Kevin", "i": 2}`)
+	addTestDocument(t, s, `{"name": "Bob"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}})
+	assert.IsType(t, []any{}, res.Body["documents"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "shape": {"map"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	documents := res.Body["documents"].(map[string]any)
+	assert.Equal(t, 2, len(documents))
+	assert.Equal(t, 1.0, documents[a].(map[string]any)["i"])
+	assert.Equal(t, 2.0, documents[b].(map[string]any)["i"])
+
+	res = searchTestDocuments(t, s, url.Values{"shape": {"tree"}})
+	assert.Equal(t, "error", res.Status)
+}
+
+func Test_query_match_field(t *testing.T) {
+	q, err := parseQuery("a:>@b")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"a"}, value: "@b", op: ">", field: []string{"b"}}}, q.ands)
+
+	tests := []struct {
+		query         string
+		doc           map[string]any
+		expectedMatch bool
+	}{
+		{"a:>@b", map[string]any{"a": 2.0, "b": 1.0}, true},
+		{"a:>@b", map[string]any{"a": 1.0, "b": 2.0}, false},
+		{"a:>=@b", map[string]any{"a": 2.0, "b": 2.0}, true},
+		{"a:@b", map[string]any{"a": 2.0, "b": 2.0}, true},
+		{"a:@b", map[string]any{"a": 2.0, "b": 3.0}, false},
+		{"a:<@x.y", map[string]any{"a": 1.0, "x": map[string]any{"y": 10.0}}, true},
+		// 10 is bigger than 9 numerically but not lexically
+		{"a:>@b", map[string]any{"a": "10", "b": "9"}, true},
+		{"a:~>@b", map[string]any{"a": "10", "b": "9"}, false},
+		{"name:@alias", map[string]any{"name": "phil", "alias": "phil"}, true},
+		{"name:@alias", map[string]any{"name": "phil", "alias": "eaton"}, false},
+		{"start:<@end", map[string]any{"start": "2024-01-01", "end": "2024-02-01"}, true},
+		{"start:>@end", map[string]any{"start": "2024-01-01", "end": "2024-02-01"}, false},
+		// Missing or non-scalar fields never match
+		{"a:@b", map[string]any{"a": 1.0}, false},
+		{"a:@b", map[string]any{"a": 1.0, "b": map[string]any{"c": 1.0}}, false},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		assert.Nil(t, err, test.query)
+		assert.Equal(t, test.expectedMatch, q.match("", test.doc), test.query)
+	}
+
+	_, err = parseQuery("a:@b.*")
+	assert.NotNil(t, err)
+	_, err = parseQuery("a:@")
+	assert.NotNil(t, err)
+
+	// Field comparisons are never answered by the index
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"a": 2, "b": 1}`)
+	addTestDocument(t, s, `{"a": 1, "b": 2}`)
+	s.reindex()
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs?q=a:>@b", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, 1.0, res.Body["count"])
+	assert.Equal(t, id, res.Body["documents"].([]any)[0].(map[string]any)["id"])
+}
+
+func Test_schema(t *testing.T) {
+	s := newTestServer(t)
+	s.schema = map[string]string{"age": "number", "created": "date", "active": "bool"}
+
+	a := addTestDocument(t, s, `{"age": 30, "created": "2024-01-01", "active": true}`)
+	b := addTestDocument(t, s, `{"age": "30", "created": "2024-01-01T02:00:00+02:00", "active": "true"}`)
+	c := addTestDocument(t, s, `{"age": 4, "created": "2024-03-01T10:00:00Z", "active": "false"}`)
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		// Numbers and numeric strings are the same number
+		{"age:30.0", []string{a, b}},
+		{"age:30", []string{a, b}},
+		{`age:"30"`, []string{a, b}},
+		{"age:>10", []string{a, b}},
+		{"age:<=4", []string{c}},
+		// Timestamps in different forms are the same instant
+		{"created:2024-01-01", []string{a, b}},
+		{`created:"2024-01-01T00:00:00.000Z"`, []string{a, b}},
+		{"created:>2024-02-01", []string{c}},
+		{"created:between(2024-01-01, 2024-01-02)", []string{a, b}},
+		{"active:true", []string{a, b}},
+		{"active:0", []string{c}},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": []string{test.query}})
+		assert.Equal(t, "ok", res.Status, res.Error)
+		assert.ElementsMatch(t, test.ids, documentIds(res), test.query)
+	}
+
+	// Values that can't be coerced are rejected
+	for _, q := range []string{"age:old", "created:yesterday", "active:maybe"} {
+		res := searchTestDocuments(t, s, url.Values{"q": []string{q}})
+		assert.Equal(t, "invalid_query", res.Code, q)
+	}
+}
+
+func Test_planQuery_equality(t *testing.T) {
+	s := newTestServer(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addTestDocument(t, s, fmt.Sprintf(`{"active": true, "i": %d}`, i)))
+	}
+	addTestDocument(t, s, `{"active": false, "i": 5}`)
+	sort.Strings(ids)
+
+	q, err := s.parseQuery("active:true")
+	assert.Nil(t, err)
+	plan, err := s.planQuery(q, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, plan.ids)
+	assert.False(t, plan.isRange)
+	assert.False(t, plan.fullScan)
+
+	// Every candidate matches so reading stops once the page is full
+	res := searchTestDocuments(t, s, url.Values{"q": {"active:true"}, "limit": {"2"}})
+	assert.Equal(t, ids[:2], documentIds(res))
+	assert.Equal(t, 2.0, res.Body["scanned"])
+
+	// With a range post-filter candidates are read until enough match
+	var matching []string
+	for _, id := range ids {
+		document, err := s.getDocumentById([]byte(id))
+		assert.Nil(t, err)
+		if document["i"].(float64) >= 3 {
+			matching = append(matching, id)
+		}
+	}
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"active:true i:>=3"}, "limit": {"1"}})
+	assert.Equal(t, matching[:1], documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"active:true i:>=3"}, "limit": {"5"}})
+	assert.Equal(t, matching, documentIds(res))
+}
+
+func Test_validateQuery(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+
+	tests := []struct {
+		q                string
+		expectedValid    bool
+		expectedError    string
+		expectedPosition any
+	}{
+		{"a:1 AND (b:>2 OR c:3)", true, "", nil},
+		{"", true, "", nil},
+		{"a:1)", false, "Unexpected closing parenthesis at 3", 3.0},
+		{"a:1 OR", false, "Expected expression at 6", 6.0},
+		{"(a:1", false, "Expected closing parenthesis at 4", 4.0},
+		{"a", false, "Expected colon at 1, got: ``", 1.0},
+		{"a:between(1)", false, "Expected two arguments to between at 2, got 1", 12.0},
+	}
+
+	for _, test := range tests {
+		body, err := json.Marshal(map[string]string{"q": test.q})
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/validate-query", strings.NewReader(string(body))))
+		assert.Equal(t, http.StatusOK, w.Code, test.q)
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, test.expectedValid, res.Body["valid"], test.q)
+		if !test.expectedValid {
+			assert.Equal(t, test.expectedError, res.Body["error"], test.q)
+		}
+		assert.Equal(t, test.expectedPosition, res.Body["position"], test.q)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/validate-query", strings.NewReader("a:1")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_indexBuckets(t *testing.T) {
+	buckets, err := parseBuckets("price=10,age=2.5")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"price": 10, "age": 2.5}, buckets)
+	for _, bad := range []string{"price", "price=0", "price=-1", "price=x"} {
+		_, err = parseBuckets(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	s := newTestServer(t)
+	s.buckets = buckets
+	for i := 0; i < 100; i++ {
+		addTestDocument(t, s, fmt.Sprintf(`{"price": %d}`, i))
+	}
+	addTestDocument(t, s, `{"price": -5}`)
+
+	tests := []struct {
+		query           string
+		expectedCount   float64
+		expectedScanned float64
+	}{
+		// Only the 90 bucket
+		{"price:>=90", 10, 10},
+		// The 80 and 90 buckets
+		{"price:>85", 14, 20},
+		{"price:<10", 11, 11},
+		{"price:<=10", 12, 21},
+		{"price:between(25, 34)", 10, 20},
+		{"price:<-5", 0, 1},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}})
+		assert.Equal(t, "ok", res.Status, res.Error)
+		assert.Equal(t, test.expectedCount, res.Body["count"], test.query)
+		assert.Equal(t, test.expectedScanned, res.Body["scanned"], test.query)
+
+		res = searchTestDocuments(t, s, url.Values{"q": {test.query}, "skipIndex": {"true"}})
+		assert.Equal(t, test.expectedCount, res.Body["count"], test.query)
+	}
+
+	// Fields without buckets still scan
+	res := searchTestDocuments(t, s, url.Values{"q": {"other:>1"}})
+	assert.Equal(t, 101.0, res.Body["scanned"])
+}
+
+func Test_maxQueryTerms(t *testing.T) {
+	s := newTestServer(t)
+	s.maxQueryTerms = 3
+
+	tests := []struct {
+		query    string
+		accepted bool
+	}{
+		{"a:1 b:2 c:3", true},
+		{"a:1 b:2 c:3 d:4", false},
+		{"a:1 (b:2 OR c:3)", true},
+		{"a:1 (b:2 OR c:3 OR d:4)", false},
+		{"a:1|2|3", true},
+		{"a:1|2|3|4", false},
+		// between is two comparisons
+		{"a:between(1, 2) b:3", true},
+		{"a:between(1, 2) b:3 c:4", false},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}})
+		if test.accepted {
+			assert.Equal(t, "ok", res.Status, test.query)
+		} else {
+			assert.Equal(t, "invalid_query", res.Code, test.query)
+			assert.Contains(t, res.Error, "more than the maximum of 3", test.query)
+		}
+	}
+}
+
+func Test_searchDocuments_total(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 10; i++ {
+		addTestDocument(t, s, fmt.Sprintf(`{"name": "Kevin", "i": %d}`, i))
+	}
+	for i := 0; i < 10; i++ {
+		addTestDocument(t, s, fmt.Sprintf(`{"name": "Bob", "i": %d}`, i))
+	}
+
+	// Index-only plans know the total without reading every match
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "limit": {"2"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	assert.Equal(t, 2.0, res.Body["scanned"])
+	assert.Equal(t, 10.0, res.Body["total"])
+	assert.Equal(t, true, res.Body["totalExact"])
+
+	// Otherwise every candidate is read for an exact total
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin i:<5"}, "limit": {"2"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	assert.Equal(t, 10.0, res.Body["scanned"])
+	assert.Equal(t, 5.0, res.Body["total"])
+	assert.Equal(t, true, res.Body["totalExact"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"i:<5"}, "limit": {"2"}})
+	assert.Equal(t, 20.0, res.Body["scanned"])
+	assert.Equal(t, 10.0, res.Body["total"])
+	assert.Equal(t, true, res.Body["totalExact"])
+
+	// Or estimated from the candidates read before the page filled
+	res = searchTestDocuments(t, s, url.Values{"q": {"i:<5"}, "limit": {"2"}, "exactTotal": {"false"}})
+	assert.Equal(t, 2.0, res.Body["count"])
+	scanned := res.Body["scanned"].(float64)
+	assert.Less(t, scanned, 20.0)
+	assert.Equal(t, float64(int(2*20/scanned)), res.Body["total"])
+	assert.Equal(t, false, res.Body["totalExact"])
+
+	// Reading everything makes the total exact anyway
+	res = searchTestDocuments(t, s, url.Values{"q": {"i:<5"}, "exactTotal": {"false"}})
+	assert.Equal(t, 10.0, res.Body["total"])
+	assert.Equal(t, true, res.Body["totalExact"])
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("HEAD", "/docs?q=name:Kevin&limit=2", nil))
+	assert.Equal(t, "10", w.Header().Get("X-Total-Count"))
+}
+
+func Test_putDocument(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	id := addTestDocument(t, s, `{"name": "Kevin", "city": "Boston", "tags": ["a", "b"]}`)
+	other := addTestDocument(t, s, `{"name": "Bob", "city": "Boston"}`)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/docs/"+id, strings.NewReader(`{"name": "Kevin", "tags": ["b", "c"]}`)))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	document := res.Body["document"].(map[string]any)
+	assert.NotContains(t, document, "city")
+	assert.Contains(t, document, "_created")
+
+	// The dropped field no longer finds the document
+	ids, err := s.lookup("city=Boston")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{other}, ids)
+	res = searchTestDocuments(t, s, url.Values{"q": {"city:Boston"}})
+	assert.Equal(t, []string{other}, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"tags:a"}})
+	assert.Nil(t, documentIds(res))
+
+	for _, q := range []string{"name:Kevin", "tags:b", "tags:c"} {
+		res = searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.Equal(t, []string{id}, documentIds(res), q)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/docs/missing", strings.NewReader(`{"name": "Kevin"}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_diffKeys(t *testing.T) {
+	removed, added := diffKeys([]string{"a=1", "b=2", "c=3"}, []string{"b=2", "c=4", "d=5"})
+	assert.Equal(t, []string{"a=1", "c=3"}, removed)
+	assert.Equal(t, []string{"c=4", "d=5"}, added)
+}
+
+func Test_importDocuments(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	existing := addTestDocument(t, s, `{"name": "Kevin", "city": "Boston"}`)
+
+	body := strings.Join([]string{
+		fmt.Sprintf(`{"_id": %q, "name": "Kevin", "city": "Denver"}`, existing),
+		`{"_id": "external-1", "name": "Bob"}`,
+		`{"name": "Alice"}`,
+		``,
+		`{"name": `,
+		`{"_id": 12, "name": "Bad"}`,
+		`{"_id": "a,b", "name": "Bad"}`,
+		`{"_id": "\u0001x", "name": "Bad"}`,
+		`{"_id": "external-1", "name": "Bobby"}`,
+	}, "\n")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/import", strings.NewReader(body)))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, 2.0, res.Body["inserted"])
+	assert.Equal(t, 2.0, res.Body["updated"])
+
+	var lines []any
+	for _, lineError := range res.Body["errors"].([]any) {
+		lines = append(lines, lineError.(map[string]any)["line"])
+	}
+	assert.Equal(t, []any{5.0, 6.0, 7.0, 8.0}, lines)
+
+	// Updates replace the document and its index entries
+	res = searchTestDocuments(t, s, url.Values{"q": {"city:Boston"}})
+	assert.Nil(t, documentIds(res))
+	res = searchTestDocuments(t, s, url.Values{"q": {"city:Denver"}})
+	assert.Equal(t, []string{existing}, documentIds(res))
+
+	document, err := s.getDocumentById([]byte("external-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Bobby", document["name"])
+	assert.NotContains(t, document, "_id")
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Bob"}})
+	assert.Nil(t, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Alice"}})
+	assert.Equal(t, 1, len(documentIds(res)))
+
+	// The id can come from another field
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/import?idField=ref", strings.NewReader(`{"ref": "external-1", "name": "Robert"}`)))
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, 1.0, res.Body["updated"])
+	assert.Equal(t, []any{}, res.Body["errors"])
+
+	document, err = s.getDocumentById([]byte("external-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "external-1", document["ref"])
+
+	// Soft deleted documents aren't updated
+	s.softDelete = true
+	router = s.routes()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/external-1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/import", strings.NewReader(`{"_id": "external-1", "name": "Rob"}`)))
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, 0.0, res.Body["updated"])
+	assert.Equal(t, 0.0, res.Body["inserted"])
+	assert.Equal(t, "Document not found: external-1", res.Body["errors"].([]any)[0].(map[string]any)["error"])
+	document, err = s.getDocumentById([]byte("external-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Robert", document["name"])
+}
+
+func Test_lexKey(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedSegments []string
+		expectedIndex    int
+	}{
+		{"a.b.c:1", []string{"a", "b", "c"}, 5},
+		{`a\.b.c:1`, []string{"a.b", "c"}, 6},
+		{`a.b\.c:1`, []string{"a", "b.c"}, 6},
+		{`a\.b\.c:1`, []string{"a.b.c"}, 7},
+		{`"first name.last":1`, []string{"first name", "last"}, 17},
+		{`"x\.y.z":1`, []string{"x.y", "z"}, 8},
+		{`url\:x:1`, []string{"url:x"}, 6},
+	}
+
+	for _, test := range tests {
+		segments, index, err := lexKey([]rune(test.input), 0)
+		assert.Nil(t, err, test.input)
+		assert.Equal(t, test.expectedSegments, segments, test.input)
+		assert.Equal(t, test.expectedIndex, index, test.input)
+	}
+
+	_, _, err := lexKey([]rune(`"a.b`), 0)
+	assert.NotNil(t, err)
+}
+
+func Test_query_match_escapedDot(t *testing.T) {
+	q, err := parseQuery(`a\.b.c:1`)
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"a.b", "c"}, value: "1", op: "="}}, q.ands)
+
+	assert.True(t, q.match("", map[string]any{"a.b": map[string]any{"c": 1.0}}))
+	assert.False(t, q.match("", map[string]any{"a": map[string]any{"b": map[string]any{"c": 1.0}}}))
+
+	// Both documents are indexed under a.b.c=1 so the index isn't enough
+	s := newTestServer(t)
+	dotted := addTestDocument(t, s, `{"a.b": {"c": 1}}`)
+	addTestDocument(t, s, `{"a": {"b": {"c": 1}}}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {`a\.b.c:1`}})
+	assert.Equal(t, []string{dotted}, documentIds(res))
+}
+
+func Test_searchDocuments_insertionOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newServer(dir+"/docdb.data", "8080")
+	assert.Nil(t, err)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addTestDocument(t, s, fmt.Sprintf(`{"name": "Kevin", "i": %d}`, i)))
+	}
+	addTestDocument(t, s, `{"name": "Bob"}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "order": {"insertion"}})
+	assert.Equal(t, ids, documentIds(res))
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin i:>=2"}, "order": {"insertion"}, "limit": {"2"}})
+	assert.Equal(t, ids[2:4], documentIds(res))
+	assert.Equal(t, 3.0, res.Body["total"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {"i:<3"}, "order": {"insertion"}})
+	assert.Equal(t, ids[:3], documentIds(res))
+
+	// Deleted documents are skipped
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("DELETE", "/docs/"+ids[1], nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "order": {"insertion"}})
+	assert.Equal(t, []string{ids[0], ids[2], ids[3], ids[4]}, documentIds(res))
+
+	// The log survives restarts and index rebuilds
+	s.close()
+	s, err = newServer(dir+"/docdb.data", "8080")
+	assert.Nil(t, err)
+	defer s.close()
+	assert.Nil(t, s.clearIndex())
+	s.reindex()
+
+	id := addTestDocument(t, s, `{"name": "Kevin"}`)
+	res = searchTestDocuments(t, s, url.Values{"q": {"name:Kevin"}, "order": {"insertion"}})
+	assert.Equal(t, []string{ids[0], ids[2], ids[3], ids[4], id}, documentIds(res))
+}
+
+func Test_backfillInsertions(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newServer(dir+"/docdb.data", "8080")
+	assert.Nil(t, err)
+
+	// Stored without going through the insertion log
+	batch := s.db.NewBatch()
+	assert.Nil(t, batch.Set([]byte("b"), []byte(`{"_created": "2024-01-01T00:00:05Z"}`), nil))
+	assert.Nil(t, batch.Set([]byte("a"), []byte(`{"_created": "2024-01-01T00:00:05.5Z"}`), nil))
+	assert.Nil(t, batch.Set([]byte("c"), []byte(`{"_created": "2024-01-01T00:00:01Z"}`), nil))
+	assert.Nil(t, batch.Set([]byte("corrupt"), []byte(`{"_created": `), nil))
+	assert.Nil(t, batch.Commit(pebble.Sync))
+	s.close()
+
+	s, err = newServer(dir+"/docdb.data", "8080")
+	assert.Nil(t, err)
+	defer s.close()
+
+	res := searchTestDocuments(t, s, url.Values{"order": {"insertion"}})
+	assert.Equal(t, []string{"c", "b", "a"}, documentIds(res))
+}
+
+func Test_redact(t *testing.T) {
+	s := newTestServer(t)
+	s.redactions = parseFields("ssn,address.zip")
+	router := s.routes()
+	id := addTestDocument(t, s, `{"name": "Kevin", "ssn": "123-45-6789", "address": {"city": "Boston", "zip": "02101"}}`)
+
+	assertRedacted := func(document map[string]any) {
+		assert.NotContains(t, document, "ssn")
+		assert.Equal(t, map[string]any{"city": "Boston"}, document["address"])
+		assert.Equal(t, "Kevin", document["name"])
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id, nil))
+	assertRedacted(decodeTestResponse(t, w).Body["document"].(map[string]any))
+
+	// Redacted fields can still be queried on
+	res := searchTestDocuments(t, s, url.Values{"q": {"ssn:123-45-6789"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+	assertRedacted(res.Body["documents"].([]any)[0].(map[string]any)["body"].(map[string]any))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"/raw", nil))
+	var raw map[string]any
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &raw))
+	assertRedacted(raw)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/docs/"+id, strings.NewReader(`{"name": "Kevin"}`)))
+	assertRedacted(decodeTestResponse(t, w).Body["document"].(map[string]any))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/distinct?field=ssn", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Still stored in full
+	document, err := s.getDocumentById([]byte(id))
+	assert.Nil(t, err)
+	assert.Equal(t, "123-45-6789", document["ssn"])
+	assert.Equal(t, "02101", document["address"].(map[string]any)["zip"])
+
+	s.redactMask = "***"
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id, nil))
+	document = decodeTestResponse(t, w).Body["document"].(map[string]any)
+	assert.Equal(t, "***", document["ssn"])
+	assert.Equal(t, "***", document["address"].(map[string]any)["zip"])
+}
+
+func Test_query_match_has(t *testing.T) {
+	q, err := parseQuery("tags:has(go, db)")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{
+		{key: []string{"tags"}, value: "go", op: "="},
+		{key: []string{"tags"}, value: "db", op: "="},
+	}, q.ands)
+
+	assert.True(t, q.match("", map[string]any{"tags": []any{"db", "web", "go"}}))
+	assert.False(t, q.match("", map[string]any{"tags": []any{"go", "web"}}))
+	assert.False(t, q.match("", map[string]any{"tags": "go"}))
+
+	_, err = parseQuery("tags:has()")
+	assert.NotNil(t, err)
+
+	s := newTestServer(t)
+	both := addTestDocument(t, s, `{"tags": ["go", "db"]}`)
+	addTestDocument(t, s, `{"tags": ["go"]}`)
+	addTestDocument(t, s, `{"tags": ["db", "sql"]}`)
+
+	res := searchTestDocuments(t, s, url.Values{"q": {"tags:has(go,db)"}})
+	assert.Equal(t, []string{both}, documentIds(res))
+	// Answered by intersecting the postings of each value
+	assert.Equal(t, 1.0, res.Body["scanned"])
+}
+
+func Test_collections(t *testing.T) {
+	s := newTestServer(t)
+	s.collections = newCollections(t.TempDir(), 0)
+	t.Cleanup(s.collections.close)
+	s.tokenizedFields = parseFields("bio")
+	router := s.routes()
+
+	add := func(path string, document string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(document)))
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "ok", res.Status, res.Error)
+		return res.Body["id"].(string)
+	}
+	search := func(path string) []string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "ok", res.Status, res.Error)
+		return documentIds(res)
+	}
+
+	users := add("/collections/users/docs", `{"name": "Kevin", "bio": "likes go"}`)
+	pets := add("/collections/pets/docs", `{"name": "Kevin"}`)
+	top := add("/docs", `{"name": "Kevin"}`)
+
+	assert.Equal(t, []string{users}, search("/collections/users/docs?q=name:Kevin"))
+	assert.Equal(t, []string{pets}, search("/collections/pets/docs?q=name:Kevin"))
+	assert.Equal(t, []string{top}, search("/docs?q=name:Kevin"))
+
+	// Collections are configured like the server
+	assert.Equal(t, []string{users}, search("/collections/users/docs?q=bio:go"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/collections/pets/docs/"+users, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/collections/users/docs/"+users, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, search("/collections/users/docs?q=name:Kevin"))
+	assert.Equal(t, []string{pets}, search("/collections/pets/docs?q=name:Kevin"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/collections/bad.name/docs", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_collections_wal(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t)
+	var err error
+	s.wal, err = openWriteAheadLog(dir+"/docdb.data.wal", 0)
+	assert.Nil(t, err)
+	s.collections = newCollections(dir+"/collections", 0)
+	t.Cleanup(s.collections.close)
+	router := s.routes()
+
+	// Left in the collection's log by a crash
+	assert.Nil(t, os.MkdirAll(dir+"/collections", 0755))
+	wal, err := openWriteAheadLog(dir+"/collections/users.wal", 0)
+	assert.Nil(t, err)
+	replayed := uuid.New().String()
+	err = wal.write([]walEntry{{Op: walSet, Id: replayed, Document: json.RawMessage(`{"name": "Kevin"}`)}}, func() error { return nil })
+	assert.Nil(t, err)
+	wal.close()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/collections/users/docs?q=name:Kevin", nil))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, []string{replayed}, documentIds(res))
+
+	// New writes go to the collection's log, not the server's
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/collections/users/docs", strings.NewReader(`{"name": "Bob"}`)))
+	id := decodeTestResponse(t, w).Body["id"].(string)
+	logged, err := os.ReadFile(dir + "/collections/users.wal")
+	assert.Nil(t, err)
+	assert.Contains(t, string(logged), id)
+	logged, err = os.ReadFile(dir + "/docdb.data.wal")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(logged), id)
+}
+
+func Test_getPathValues_endpoint(t *testing.T) {
+	s := newTestServer(t)
+	s.indexExclude = parseFields("_created,_updated,secret")
+	id := addTestDocument(t, s, `{"name": "Kevin", "address": {"city": "Boston", "geo": {"lat": 42}}, "tags": ["a", {"b": 1}], "secret": "x", "a=b": "c"}`)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"/pathvalues", nil))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, []any{
+		`a\=b=c`,
+		"address.city=Boston",
+		"address.geo.lat=42",
+		"name=Kevin",
+		"tags=a",
+	}, res.Body["pathValues"])
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/missing/pathvalues", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Redacted values aren't given away by their keys, tokens included
+	s.redactions = parseFields("ssn,address")
+	s.tokenizedFields = parseFields("ssn")
+	id = addTestDocument(t, s, `{"name": "Kevin", "ssn": "123-45-6789", "address": {"city": "Boston"}}`)
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs/"+id+"/pathvalues", nil))
+	res = decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, []any{"name=Kevin"}, res.Body["pathValues"])
+}
+
+func Test_batchDeleteDocuments(t *testing.T) {
+	s := newTestServer(t)
+	a := addTestDocument(t, s, `{"name": "Kevin"}`)
+	b := addTestDocument(t, s, `{"name": "Kevin"}`)
+	c := addTestDocument(t, s, `{"name": "Kevin"}`)
+
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"ids": [%q, "missing", %q]}`, a, b)
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/docs/batch-delete", strings.NewReader(body)))
+	res := decodeTestResponse(t, w)
+	assert.Equal(t, "ok", res.Status, res.Error)
+	assert.Equal(t, 2.0, res.Body["deleted"])
+
+	results := res.Body["results"].([]any)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, map[string]any{"id": a, "deleted": true}, results[0])
+	assert.Equal(t, map[string]any{"id": "missing", "deleted": false, "error": "Document not found: missing"}, results[1])
+	assert.Equal(t, map[string]any{"id": b, "deleted": true}, results[2])
+
+	ids, err := s.lookup("name=Kevin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{c}, ids)
+
+	_, err = s.getDocumentById([]byte(a))
+	assert.True(t, isNotFound(err))
+}
+
+func Test_query_match_count(t *testing.T) {
+	q, err := parseQuery("tags:count>2")
+	assert.Nil(t, err)
+	assert.Equal(t, []queryComparison{{key: []string{"tags"}, value: "2", op: ">", count: true}}, q.ands)
+
+	docs := []map[string]any{
+		{"tags": []any{}},
+		{"tags": []any{"a"}},
+		{"tags": []any{"a", "b"}},
+		{"tags": []any{"a", "b", "c"}},
+		{"tags": "a"},
+		{},
+	}
+
+	tests := []struct {
+		query           string
+		expectedMatches []bool
+	}{
+		{"tags:count>2", []bool{false, false, false, true, false, false}},
+		{"tags:count>=2", []bool{false, false, true, true, false, false}},
+		{"tags:count<2", []bool{true, true, false, false, false, false}},
+		{"tags:count<=1", []bool{true, true, false, false, false, false}},
+		{"tags:count=0", []bool{true, false, false, false, false, false}},
+		{"tags:count=2", []bool{false, false, true, false, false, false}},
+		// Without an operator count is a plain value
+		{"tags:count", []bool{false, false, false, false, false, false}},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		assert.Nil(t, err, test.query)
+		for i, doc := range docs {
+			assert.Equal(t, test.expectedMatches[i], q.match("", doc), test.query, doc)
+		}
+	}
+
+	for _, bad := range []string{"tags:count>x", "tags:count>", "*:count>1"} {
+		_, err = parseQuery(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"tags": ["a", "b", "c"]}`)
+	addTestDocument(t, s, `{"tags": ["a"]}`)
+	res := searchTestDocuments(t, s, url.Values{"q": {"tags:count>=2"}})
+	assert.Equal(t, []string{id}, documentIds(res))
+}
+
+func Test_addDocument_strictJSON(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		document      string
+		expectedError string
+	}{
+		{`{"a": 1, "b": {"c": [1, {"d": 2}]}}`, ""},
+		{"{\"a\": 1}\n", ""},
+		{`{"a": 1} {"b": 2}`, "Unexpected data after the document ending at offset 8"},
+		{`{"a": 1} x`, "Unexpected data after the document ending at offset 8"},
+		{`{"a": 1, "a": 2}`, `Duplicate key "a" at offset 12`},
+		{`{"a": {"b": 1, "c": {}, "b": 2}}`, `Duplicate key "b" at offset 27`},
+		{`{"a": [{"b": 1, "b": 1}]}`, `Duplicate key "b" at offset 19`},
+		// The same key in different objects is fine
+		{`{"a": {"b": 1}, "c": {"b": 1}}`, ""},
+	}
+
+	for _, test := range tests {
+		// Accepted without -strict-json
+		s.strictJSON = false
+		w := httptest.NewRecorder()
+		s.addDocument(w, httptest.NewRequest("POST", "/docs", strings.NewReader(test.document)), nil)
+		assert.Equal(t, http.StatusOK, w.Code, test.document)
+
+		s.strictJSON = true
+		w = httptest.NewRecorder()
+		s.addDocument(w, httptest.NewRequest("POST", "/docs", strings.NewReader(test.document)), nil)
+		res := decodeTestResponse(t, w)
+		if test.expectedError == "" {
+			assert.Equal(t, "ok", res.Status, test.document)
+		} else {
+			assert.Equal(t, "invalid_document", res.Code, test.document)
+			assert.Equal(t, test.expectedError, res.Error, test.document)
+		}
+	}
+}
+
+func Test_cardinalityValues(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	for _, document := range []string{
+		`{"status": "active", "a=b": "x"}`,
+		`{"status": "active", "a": "y"}`,
+		`{"status": "a=b", "a=b": "x=y"}`,
+		`{"status": "pending", "statuses": ["a", "b", "c"]}`,
+		`{"tags": ["a", "b"]}`,
+		`{"tags": ["b", "c"], "status": "x"}`,
+	} {
+		addTestDocument(t, s, document)
+	}
+
+	cardinality := func(field string) any {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/cardinality?field="+url.QueryEscape(field), nil))
+		res := decodeTestResponse(t, w)
+		assert.Equal(t, "ok", res.Status, res.Error)
+		return res.Body["cardinality"]
+	}
+
+	// Paths and values with '=' in them are counted under the right
+	// field
+	assert.Equal(t, 4.0, cardinality("status"))
+	assert.Equal(t, 2.0, cardinality("a=b"))
+	assert.Equal(t, 1.0, cardinality("a"))
+	assert.Equal(t, 3.0, cardinality("tags"))
+	assert.Equal(t, 0.0, cardinality("missing"))
+
+	// Fields that aren't indexed are counted from the documents
+	s.indexExclude = parseFields("status")
+	router = s.routes()
+	assert.Equal(t, 4.0, cardinality("status"))
+	count, err := s.countDistinct("status")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), count)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/cardinality", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_addDocument_unlessExists(t *testing.T) {
+	s := newTestServer(t)
+	id := addTestDocument(t, s, `{"email": "kevin@example.com"}`)
+
+	insert := func(document string) (int, testResponse) {
+		w := httptest.NewRecorder()
+		q := url.Values{"unlessExists": {`email:"kevin@example.com"`}}
+		s.addDocument(w, httptest.NewRequest("POST", "/docs?"+q.Encode(), strings.NewReader(document)), nil)
+		return w.Code, decodeTestResponse(t, w)
+	}
+
+	code, res := insert(`{"email": "kevin@example.com", "name": "Kevin"}`)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "conflict", res.Code)
+	assert.Equal(t, id, res.Body["id"])
+
+	res = searchTestDocuments(t, s, url.Values{"q": {`email:"kevin@example.com"`}})
+	assert.Equal(t, []string{id}, documentIds(res))
+
+	// Inserted once nothing matches
+	assert.Nil(t, s.delete(id))
+	code, res = insert(`{"email": "kevin@example.com"}`)
+	assert.Equal(t, http.StatusOK, code, res.Error)
+
+	// Only one of concurrent conditional inserts succeeds
+	var wg sync.WaitGroup
+	var inserted int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			q := url.Values{"unlessExists": {"name:Bob"}}
+			s.addDocument(w, httptest.NewRequest("POST", "/docs?"+q.Encode(), strings.NewReader(`{"name": "Bob"}`)), nil)
+			if w.Code == http.StatusOK {
+				atomic.AddInt64(&inserted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), inserted)
+}
+
+func Test_query_arrayIndex(t *testing.T) {
+	s := newTestServer(t)
+	first := addTestDocument(t, s, `{"items": [{"name": "foo"}, {"name": "bar"}], "tags": ["go"]}`)
+	second := addTestDocument(t, s, `{"items": [{"name": "bar"}, {"name": "foo"}], "tags": ["rust", "go"]}`)
+
+	tests := []struct {
+		query       string
+		expectedIds []string
+	}{
+		{"items.0.name:foo", []string{first}},
+		{"items.1.name:foo", []string{second}},
+		{"items.2.name:foo", nil},
+		{"tags.0:go", []string{first}},
+		{"tags.1:go", []string{second}},
+		{"tags.5:go", nil},
+	}
+
+	for _, test := range tests {
+		res := searchTestDocuments(t, s, url.Values{"q": {test.query}})
+		ids := documentIds(res)
+		sort.Strings(ids)
+		expected := append([]string(nil), test.expectedIds...)
+		sort.Strings(expected)
+		assert.Equal(t, expected, ids, test.query)
+	}
+}
+
+func Test_appendDocument(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	id := addTestDocument(t, s, `{"tags": ["go"], "name": "Kevin", "meta": {}}`)
+
+	appendValue := func(body string) (int, testResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/"+id+"/append", strings.NewReader(body)))
+		return w.Code, decodeTestResponse(t, w)
+	}
+
+	code, res := appendValue(`{"path": "tags", "value": "db"}`)
+	assert.Equal(t, http.StatusOK, code, res.Error)
+	assert.Equal(t, []any{"go", "db"}, res.Body["document"].(map[string]any)["tags"])
+
+	// Missing arrays and the objects above them are created
+	code, res = appendValue(`{"path": "meta.labels", "value": 1}`)
+	assert.Equal(t, http.StatusOK, code, res.Error)
+	assert.Equal(t, map[string]any{"labels": []any{1.0}}, res.Body["document"].(map[string]any)["meta"])
+	code, _ = appendValue(`{"path": "owners", "value": "Sam"}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	// Only the new elements' index entries are added
+	for _, q := range []string{"tags:db", "tags:go", "meta.labels:1", "owners:Sam"} {
+		res = searchTestDocuments(t, s, url.Values{"q": {q}})
+		assert.Equal(t, []string{id}, documentIds(res), q)
+	}
+
+	code, res = appendValue(`{"path": "name", "value": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "Expected name to be an array or missing", res.Error)
+	code, _ = appendValue(`{"path": "name.first", "value": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = appendValue(`{"value": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/missing/append", strings.NewReader(`{"path": "tags", "value": 1}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The routes sharing POST /docs/:id still work
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/validate-query", strings.NewReader(`{"q": "a:1"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/docs/"+id, strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "method_not_allowed", decodeTestResponse(t, w).Code)
+
+	// Reserved keys can't be appended to
+	for _, key := range []string{"_created", "_updated.x", "_deleted", "_id"} {
+		code, _ = appendValue(fmt.Sprintf(`{"path": %q, "value": 1}`, key))
+		assert.Equal(t, http.StatusBadRequest, code, key)
+	}
+
+	// The body and the resulting document are checked like any other
+	s.strictJSON = true
+	s.maxDepth = 3
+	router = s.routes()
+	code, res = appendValue(`{"path": "tags", "value": "a", "value": "b"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "invalid_document", res.Code)
+	code, _ = appendValue(`{"path": "tags", "value": {"a": 1}}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, res = appendValue(`{"path": "a.b.c", "value": 1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "Document is nested more than 3 levels deep", res.Error)
+}
+
+func Test_sampleDocuments(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+
+	sample := func(n string) testResponse {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/sample?n="+n, nil))
+		return decodeTestResponse(t, w)
+	}
+
+	assert.Equal(t, []any{}, sample("3").Body["documents"])
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, addTestDocument(t, s, fmt.Sprintf(`{"i": %d}`, i)))
+	}
+	s.softDelete = true
+	assert.Nil(t, s.delete(ids[0]))
+	router = s.routes()
+
+	res := sample("5")
+	assert.Equal(t, 5.0, res.Body["count"])
+	sampled := documentIds(res)
+	assert.Equal(t, 5, len(sampled))
+	assert.Subset(t, ids[1:], sampled)
+
+	// Capped at how many documents there are, less the deleted one
+	res = sample("100")
+	assert.ElementsMatch(t, ids[1:], documentIds(res))
+
+	// Every document turns up eventually
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		for _, id := range documentIds(sample("1")) {
+			seen[id] = true
+		}
+	}
+	assert.Greater(t, len(seen), 10)
+
+	for _, n := range []string{"0", "-1", "x"} {
+		assert.Equal(t, "bad_request", sample(n).Code, n)
+	}
+}
+
+func Test_applyIndexOps_append(t *testing.T) {
+	// Merges sort and dedupe across formats, in the newest one
+	m, err := postingsMerger.Merge(nil, []byte("c,a"))
+	assert.Nil(t, err)
+	assert.Nil(t, m.MergeOlder([]byte("b,c")))
+	assert.Nil(t, m.MergeNewer([]byte("a,d")))
+	merged, _, err := m.Finish(true)
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b,c,d", string(merged))
+
+	id := uuid.New().String()
+	m, err = postingsMerger.Merge(nil, []byte("ffff"))
+	assert.Nil(t, err)
+	assert.Nil(t, m.MergeNewer(encodePostings([]string{id}, true)))
+	merged, _, err = m.Finish(true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id, "ffff"}, decodePostings(merged))
+
+	for _, binary := range []bool{false, true} {
+		s := newTestServer(t)
+		s.binaryPostings = binary
+
+		var ids []string
+		for i := 0; i < 6; i++ {
+			ids = append(ids, uuid.New().String())
+		}
+
+		// The first add writes the key, later ones in any order are
+		// merged onto it, several in the same batch and duplicates too
+		s.applyIndexOps([]indexOp{{id: ids[0], add: []string{"name=Kevin"}}})
+		s.applyIndexOps([]indexOp{{id: ids[1], add: []string{"name=Kevin"}}, {id: ids[2], add: []string{"name=Kevin"}}})
+		s.applyIndexOps([]indexOp{{id: ids[2], add: []string{"name=Kevin"}}, {id: ids[3], add: []string{"name=Kevin"}}, {id: ids[3], add: []string{"name=Kevin"}}})
+		s.applyIndexOps([]indexOp{{id: ids[4], add: []string{"name=Kevin"}}})
+
+		stored, closer, err := s.indexDb.Get([]byte("name=Kevin"))
+		assert.Nil(t, err)
+		assert.Equal(t, binary, stored[0] == binaryPostingsFormat)
+		closer.Close()
+
+		expected := append([]string{}, ids[:5]...)
+		sort.Strings(expected)
+		found, err := s.lookup("name=Kevin")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, found, binary)
+		assert.Equal(t, int64(1), s.cardinality.get("name"))
+
+		// Removing after merging in the same batch
+		s.applyIndexOps([]indexOp{{id: ids[5], add: []string{"name=Kevin"}}, {id: ids[0], remove: []string{"name=Kevin"}}})
+		expected = append([]string{}, ids[1:]...)
+		sort.Strings(expected)
+		found, err = s.lookup("name=Kevin")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, found, binary)
+
+		// Merged postings survive flushes and compactions
+		assert.Nil(t, s.indexDb.Flush())
+		assert.Nil(t, s.indexDb.Compact([]byte("a"), []byte("z"), true))
+		found, err = s.lookup("name=Kevin")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, found, binary)
+	}
+}
+
+func benchmarkPopularValue(b *testing.B, newId func() string) {
+	s, err := newServer(b.TempDir()+"/docdb.data", "8080")
+	assert.Nil(b, err)
+	defer s.close()
+	s.binaryPostings = true
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.applyIndexOps([]indexOp{{id: newId(), add: []string{"status=active"}}})
+	}
+}
+
+func BenchmarkIndex_popularValue(b *testing.B) {
+	b.Run("v4", func(b *testing.B) {
+		benchmarkPopularValue(b, func() string { return uuid.New().String() })
+	})
+	b.Run("v7", func(b *testing.B) {
+		g := &uuidV7Generator{}
+		benchmarkPopularValue(b, func() string {
+			id, _ := g.new(time.Now())
+			return id.String()
+		})
+	})
+}